@@ -0,0 +1,249 @@
+package kht
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// A BatchHash computes many keyed hashes at once, for backends which hash
+// several independent messages faster together than one at a time, such as
+// multi-buffer SHA-256 on AVX2 or SHA-NI, or parallel BLAKE3. A BatchHash must
+// compute the same function as the tree's keyed hash. This package provides
+// HMACBatch, which shares work between messages with the same key, and
+// ParallelBatch, which spreads a batch across goroutines; SIMD multi-buffer
+// backends can be supplied by other packages.
+type BatchHash interface {
+	// SumBatch sets sums[i] to the keyed hash of msgs[i] with keys[i], for
+	// each i. It may reuse the capacity of sums[i].
+	SumBatch(sums, keys, msgs [][]byte)
+}
+
+// WithBatchHash returns an Option which derives the keys of ranges of blocks
+// (see Keys and KeysRange) a level at a time, passing every node of a level
+// to the given BatchHash at once instead of deriving one path at a time. The
+// siblings at each level are independent of one another, so a backend which
+// hashes them together can push bulk derivation (e.g., when re-encrypting an
+// entire object) well beyond the throughput of the tree's keyed hash alone.
+// Deriving a range this way holds the keys of every node covering it, and
+// bypasses the node cache.
+//
+// Creating the tree returns an error if the BatchHash doesn't compute the same
+// function as the tree's keyed hash.
+func WithBatchHash(b BatchHash) Option {
+	return func(t *KeyedHashTree) {
+		t.batch = b
+	}
+}
+
+// checkBatch returns an error if the tree's BatchHash doesn't match its keyed
+// hash.
+func (t *KeyedHashTree) checkBatch() error {
+	if t.batch == nil {
+		return nil
+	}
+
+	sums := [][]byte{nil}
+	t.batch.SumBatch(sums, [][]byte{probeKey}, [][]byte{probeMsg})
+	if !bytes.Equal(sums[0], fingerprint(t.alg)) {
+		return errors.New("kht: batch hash doesn't match the tree's keyed hash")
+	}
+	return nil
+}
+
+// ParallelBatch returns a BatchHash which computes batches with the given
+// keyed hash across GOMAXPROCS goroutines. It's a portable backend for when no
+// multi-buffer implementation of the keyed hash is available, and it scales
+// with the number of cores rather than the width of their vector units.
+func ParallelBatch(alg KeyedHash) BatchHash {
+	return parallelBatch{alg: alg}
+}
+
+type parallelBatch struct {
+	alg KeyedHash
+}
+
+// minParallelBatch is the smallest number of hashes worth giving a goroutine.
+const minParallelBatch = 64
+
+func (p parallelBatch) SumBatch(sums, keys, msgs [][]byte) {
+	workers := min(runtime.GOMAXPROCS(0), len(msgs)/minParallelBatch)
+	if workers <= 1 {
+		p.sum(sums, keys, msgs)
+		return
+	}
+
+	var wg sync.WaitGroup
+	chunk := (len(msgs) + workers - 1) / workers
+	for lo := 0; lo < len(msgs); lo += chunk {
+		hi := min(lo+chunk, len(msgs))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.sum(sums[lo:hi], keys[lo:hi], msgs[lo:hi])
+		}()
+	}
+	wg.Wait()
+}
+
+func (p parallelBatch) sum(sums, keys, msgs [][]byte) {
+	for i, msg := range msgs {
+		h := p.alg(keys[i])
+		_, _ = h.Write(msg)
+		sums[i] = h.Sum(sums[i][:0])
+		wipeHash(h)
+	}
+}
+
+// HMACBatch returns a BatchHash which computes the same function as
+// HMAC(alg), and which hashes each key's pads once per batch rather than once
+// per message. HMAC spends a compression of the underlying hash on each of its
+// two padded keys before it hashes anything else, and the siblings at each
+// level of a tree share their parent's key, so a batch of a level's nodes
+// hashes the pads of each parent once and restores the resulting states for
+// every child. For the 16-byte messages of a tree's nodes, that halves the
+// compressions per node, from four to two.
+//
+// The pads' states are saved with the hash's encoding.BinaryAppender and
+// restored with its encoding.BinaryUnmarshaler, as implemented by the hashes
+// in crypto/sha256 and crypto/sha512. For hashes which implement neither,
+// each key's pads are still hashed once per batch, but the inner hash's state
+// is recomputed for each message.
+func HMACBatch(alg func() hash.Hash) BatchHash {
+	return hmacBatch{alg: alg}
+}
+
+type hmacBatch struct {
+	alg func() hash.Hash
+}
+
+// stateHash is a hash whose state can be saved and restored.
+type stateHash interface {
+	hash.Hash
+	encoding.BinaryAppender
+	encoding.BinaryUnmarshaler
+}
+
+func (b hmacBatch) SumBatch(sums, keys, msgs [][]byte) {
+	h := newHMAC(b.alg)
+	defer h.wipe()
+
+	work, ok := b.alg().(stateHash)
+	if !ok {
+		for i, msg := range msgs {
+			if i == 0 || !bytes.Equal(keys[i], keys[i-1]) {
+				h.rekey(keys[i])
+			} else {
+				h.Reset()
+			}
+			_, _ = h.Write(msg)
+			sums[i] = h.Sum(sums[i][:0])
+		}
+		return
+	}
+	defer work.Reset()
+
+	var inner, outer, in []byte
+	defer func() {
+		Wipe(inner)
+		Wipe(outer)
+		Wipe(in)
+	}()
+
+	for i, msg := range msgs {
+		if i == 0 || !bytes.Equal(keys[i], keys[i-1]) {
+			h.rekey(keys[i]) // writes the inner pad
+			inner, _ = h.inner.(stateHash).AppendBinary(inner[:0])
+
+			h.outer.Reset()
+			_, _ = h.outer.Write(h.opad)
+			outer, _ = h.outer.(stateHash).AppendBinary(outer[:0])
+		}
+
+		_ = work.UnmarshalBinary(inner)
+		_, _ = work.Write(msg)
+		in = work.Sum(in[:0])
+
+		_ = work.UnmarshalBinary(outer)
+		_, _ = work.Write(in)
+		sums[i] = work.Sum(sums[i][:0])
+	}
+}
+
+// batchKeys returns the derived keys of count consecutive blocks, starting with
+// the block containing the given offset, deriving each level of the nodes
+// covering them with a single batch.
+func (t *KeyedHashTree) batchKeys(offset, count uint64) [][]byte {
+	if t.root == nil {
+		panic("tree has no key")
+	}
+
+	first := offset
+	if t.checkOffset(first) != nil {
+		panic("offset greater than maximum size")
+	}
+
+	last := first - first%t.blockSize + (count-1)*t.blockSize
+	if count-1 > (t.limit-1-first)/t.blockSize || t.checkOffset(last) != nil {
+		panic("offset greater than maximum size")
+	}
+
+	var began time.Time
+	if t.observer != nil {
+		began = time.Now()
+	}
+
+	keys := [][]byte{t.root}
+	lo, hashes := uint64(0), uint64(0) // lo is the index of the first node in keys
+	for i := t.top; i < t.depth; i++ {
+		level := i + 1
+		size := t.nodeSize(level)
+		y0, y1 := first/size, last/size
+
+		n := y1 - y0 + 1
+		msgs := make([][]byte, n)
+		parents := make([][]byte, n)
+		buf := make([]byte, 16*n)
+		for j := range n {
+			y := y0 + j
+			msg := buf[16*j : 16*j+16]
+			binary.LittleEndian.PutUint64(msg, i)
+			binary.LittleEndian.PutUint64(msg[8:], y)
+			msgs[j] = msg
+
+			if i == t.top {
+				parents[j] = keys[0] // the root may have more than factor children
+			} else {
+				parents[j] = keys[y/t.factor-lo]
+			}
+		}
+
+		sums := make([][]byte, n)
+		t.batch.SumBatch(sums, parents, msgs)
+		hashes += n
+		if i != t.top {
+			for _, k := range keys {
+				Wipe(k)
+			}
+		}
+		keys, lo = sums, y0
+	}
+
+	if t.depth == t.top {
+		keys = [][]byte{append([]byte(nil), t.root...)} // the root is the only leaf
+	}
+
+	for i, k := range keys {
+		keys[i] = t.output(k)
+	}
+
+	if t.observer != nil {
+		t.observe(Derivation{Offset: first, Level: t.depth, Nodes: count, Hashes: hashes}, began)
+	}
+	return keys
+}
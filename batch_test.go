@@ -0,0 +1,114 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestBatchHash(t *testing.T) {
+	opts := []kht.Option{kht.WithBatchHash(kht.ParallelBatch(kht.HMAC(md5.New)))}
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 4096, 4)
+	batched := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 4096, 4, opts...)
+
+	ranges := [][2]uint64{{0, 4096}, {0, 1}, {3, 4}, {7, 301}, {4000, 4096}}
+	for _, r := range ranges {
+		keys, err := batched.KeysRange(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, err := tree.KeysRange(r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys) != len(want) {
+			t.Fatalf("Range %v had %d keys, but expected %d", r, len(keys), len(want))
+		}
+
+		for i := range keys {
+			if !bytes.Equal(keys[i], want[i]) {
+				t.Errorf("Key %d of range %v was %#v, but expected %#v", i, r, keys[i], want[i])
+			}
+		}
+	}
+
+	grown, err := batched.Grow(1 << 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := grown.Keys(1<<15, 3), tree.Keys(0, 3); bytes.Equal(v[0], want[0]) {
+		t.Error("Grown tree derived keys of the original root's first child")
+	}
+
+	if v, want := grown.Keys(100, 2), tree.Keys(100, 2); !bytes.Equal(v[1], want[1]) {
+		t.Errorf("Grown key was %#v, but expected %#v", v[1], want[1])
+	}
+
+	sub, err := batched.Subtree(2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := sub.Keys(5*512+6, 4), tree.Keys(5*512+6, 4); !bytes.Equal(v[3], want[3]) {
+		t.Errorf("Subtree key was %#v, but expected %#v", v[3], want[3])
+	}
+
+	if _, err := sub.KeysRange(6*512-2, 6*512+2); err == nil {
+		t.Error("Derived keys outside of a subtree")
+	}
+}
+
+func TestHMACBatch(t *testing.T) {
+	for name, alg := range map[string]func() hash.Hash{"sha256": sha256.New, "md5": md5.New, "unsaved": unsavedSHA256} {
+		t.Run(name, func(t *testing.T) {
+			tree := mustNew(t, []byte("yay"), kht.HMAC(alg), 2, 4096, 4)
+			batched := mustNew(t, []byte("yay"), kht.HMAC(alg), 2, 4096, 4,
+				kht.WithBatchHash(kht.HMACBatch(alg)))
+
+			keys, want := batched.Keys(6, 300), tree.Keys(6, 300)
+			for i := range keys {
+				if !bytes.Equal(keys[i], want[i]) {
+					t.Fatalf("Key %d was %#v, but expected %#v", i, keys[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+// unsavedSHA256 returns a SHA-256 hash whose state can't be saved.
+func unsavedSHA256() hash.Hash {
+	return struct{ hash.Hash }{sha256.New()}
+}
+
+func TestBatchHashMismatch(t *testing.T) {
+	_, err := kht.New([]byte("yay"), kht.HMAC(md5.New), 2, 4096, 4,
+		kht.WithBatchHash(kht.ParallelBatch(kht.HMAC(sha256.New))))
+	if err == nil {
+		t.Error("Created a tree with a mismatched batch hash")
+	}
+}
+
+func BenchmarkKeysBatch(b *testing.B) {
+	for name, opts := range map[string][]kht.Option{
+		"scalar":   nil,
+		"parallel": {kht.WithBatchHash(kht.ParallelBatch(kht.HMAC(sha256.New)))},
+		"hmac":     {kht.WithBatchHash(kht.HMACBatch(sha256.New))},
+	} {
+		b.Run(name, func(b *testing.B) {
+			tree := mustNew(b, []byte("yay"), kht.HMAC(sha256.New), 4096, 1<<30, 1024, opts...)
+			b.SetBytes(1 << 30)
+			b.ResetTimer()
+
+			for range b.N {
+				_ = tree.Keys(0, 1<<18)
+			}
+		})
+	}
+}
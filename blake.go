@@ -0,0 +1,47 @@
+package kht
+
+import (
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/blake3"
+)
+
+// BLAKE2b returns a keyed hash implementation using BLAKE2b-256's native keyed
+// mode, which costs one compression per node rather than HMAC's four. BLAKE2b
+// accepts keys of up to 64 bytes, which covers every node key; longer root
+// keys are first hashed with unkeyed BLAKE2b-256, as HMAC does with keys
+// longer than its block size.
+func BLAKE2b() KeyedHash {
+	return func(key []byte) hash.Hash {
+		if len(key) > blake2b.Size {
+			k := blake2b.Sum256(key)
+			key = k[:]
+		}
+
+		h, err := blake2b.New256(key)
+		if err != nil {
+			panic(err) // unreachable: the key is never longer than 64 bytes
+		}
+		return h
+	}
+}
+
+var blake3Context = "kht 2024-01-01 BLAKE3 root key"
+
+// BLAKE3 returns a keyed hash implementation using BLAKE3's native keyed mode,
+// with 32-byte output. BLAKE3 requires keys of exactly 32 bytes, which every
+// node key is. Root keys of any other length are first turned into 32-byte
+// keys with BLAKE3's key derivation mode, using the context string "kht
+// 2024-01-01 BLAKE3 root key", so that no key is ever truncated or padded.
+func BLAKE3() KeyedHash {
+	return func(key []byte) hash.Hash {
+		if len(key) != 32 {
+			var k [32]byte
+			blake3.DeriveKey(k[:], blake3Context, key)
+			defer Wipe(k[:])
+			return blake3.New(32, k[:])
+		}
+		return blake3.New(32, key)
+	}
+}
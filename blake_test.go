@@ -0,0 +1,73 @@
+package kht_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestBLAKE2b(t *testing.T) {
+	tests := []struct {
+		key  []byte
+		want string
+	}{
+		// hashlib.blake2b(b"abc", key=b"yay", digest_size=32)
+		{[]byte("yay"), "fa1fed602a3530943d4f3ffa734e99688d42a6475596d3fb1409953367fc46b8"},
+		// keys longer than 64 bytes are hashed first
+		{bytes.Repeat([]byte("a"), 100), "fe7a3c1e9232206fca883b65ec76a7af9f828dd58d68ceb8d0ba2f65f26b2858"},
+	}
+
+	for _, test := range tests {
+		h := kht.BLAKE2b()(test.key)
+		_, _ = h.Write([]byte("abc"))
+		if v := hex.EncodeToString(h.Sum(nil)); v != test.want {
+			t.Errorf("BLAKE2b for %d-byte key was %s, but expected %s", len(test.key), v, test.want)
+		}
+	}
+}
+
+func TestBLAKE3(t *testing.T) {
+	// The keyed_hash vector for an empty input from the BLAKE3 test vectors.
+	h := kht.BLAKE3()([]byte("whats the Elvish word for friend"))
+	want := "92b2b75604ed3c761f9d6f62392c8a9227ad0ea3f09573e783f1498a4ed60d26"
+	if v := hex.EncodeToString(h.Sum(nil)); v != want {
+		t.Errorf("BLAKE3 was %s, but expected %s", v, want)
+	}
+
+	// Keys which aren't 32 bytes long are derived, not used directly.
+	a := kht.BLAKE3()([]byte("yay")).Sum(nil)
+	b := kht.BLAKE3()([]byte("yay\x00")).Sum(nil)
+	if bytes.Equal(a, b) {
+		t.Error("Different short keys produced the same hash")
+	}
+}
+
+func TestNativeKeyedHashTree(t *testing.T) {
+	for name, alg := range map[string]kht.KeyedHash{
+		"BLAKE2b": kht.BLAKE2b(),
+		"BLAKE3":  kht.BLAKE3(),
+	} {
+		tree := mustNew(t, []byte("yay"), alg, 2, 8, 2)
+
+		k := []byte("yay")
+		for level, index := range []uint64{5 / 4, 5 / 2} {
+			var msg [16]byte
+			binary.LittleEndian.PutUint64(msg[:], uint64(level))
+			binary.LittleEndian.PutUint64(msg[8:], index)
+			k = sum(alg(k), msg[:])
+		}
+
+		if v := tree.Key(5); !bytes.Equal(v, k) {
+			t.Errorf("%s key was %#v, but expected %#v", name, v, k)
+		}
+	}
+}
+
+func sum(h hash.Hash, msg []byte) []byte {
+	_, _ = h.Write(msg)
+	return h.Sum(nil)
+}
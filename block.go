@@ -0,0 +1,272 @@
+package kht
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// AESGCM returns an AES-GCM cipher for the given key, which must be 16, 24, or
+// 32 bytes long. It is an AEAD.
+func AESGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+var (
+	nonceInfo = []byte("kht nonce")
+	nonceHash = HMAC(sha256.New) // expands the nonces of Derivers other than trees
+
+	errBlockTooLong  = errors.New("kht: plaintext longer than block size")
+	errBlockTooShort = errors.New("kht: sealed block too short")
+)
+
+// KeyNonce returns the derived key at the given offset (as with Key) and an
+// n-byte nonce for the block containing it. The nonce is the first n bytes of
+// HKDF-Expand(PRK=leaf, info="kht nonce"), where leaf is the key of the leaf
+// node containing the offset, so it's independent of the key and of every
+// other key and nonce in the tree. Every block of a tree has a different
+// nonce, as do the same block of trees with different root keys, so unless a
+// block is encrypted twice under the same root key, no key and nonce pair is
+// ever reused. It panics if n is not between 1 and 255 times the hash size, or
+// if the offset is not less than the tree's covered size.
+func (t *KeyedHashTree) KeyNonce(offset uint64, n int) (key, nonce []byte) {
+	if n <= 0 || n > 255*t.hashSize {
+		panic("nonce length out of range")
+	}
+
+	leaf := t.leaf(offset)
+	defer Wipe(leaf)
+
+	nonce = expand(t.alg, leaf, nonceInfo, n)
+	return t.output(append([]byte(nil), leaf...)), nonce
+}
+
+// EncryptBlock seals the given plaintext, which must be no longer than the
+// tree's block size, as the block containing the given offset, appending the
+// ciphertext to dst. It's EncryptBlock with the tree as the Deriver, so the
+// block's nonce is its NonceSize-byte nonce from KeyNonce.
+func (t *KeyedHashTree) EncryptBlock(aead AEAD, offset uint64, plaintext, dst []byte) ([]byte, error) {
+	return EncryptBlock(t, aead, offset, plaintext, dst)
+}
+
+// DecryptBlock opens the given ciphertext, sealed by EncryptBlock as the block
+// containing the given offset, appending the plaintext to dst. It's
+// DecryptBlock with the tree as the Deriver.
+func (t *KeyedHashTree) DecryptBlock(aead AEAD, offset uint64, ciphertext, dst []byte) ([]byte, error) {
+	return DecryptBlock(t, aead, offset, ciphertext, dst)
+}
+
+// SealBlock is like EncryptBlock, but seals the block with a random nonce. It's
+// SealBlock with the tree as the Deriver.
+func (t *KeyedHashTree) SealBlock(aead AEAD, offset uint64, plaintext, dst []byte) ([]byte, error) {
+	return SealBlock(t, aead, offset, plaintext, dst)
+}
+
+// OpenBlock opens the given sealed block, sealed by SealBlock as the block
+// containing the given offset, appending the plaintext to dst. It's OpenBlock
+// with the tree as the Deriver.
+func (t *KeyedHashTree) OpenBlock(aead AEAD, offset uint64, sealed, dst []byte) ([]byte, error) {
+	return OpenBlock(t, aead, offset, sealed, dst)
+}
+
+// EncryptBlock seals the given plaintext, which must be no longer than d's
+// block size, as the block containing the given offset, appending the
+// ciphertext to dst. The cipher is created by aead with the block's derived
+// key.
+//
+// The nonce is derived from the block's key: for a KeyedHashTree, it's the
+// block's NonceSize-byte nonce from KeyNonce, and for any other Deriver, it's
+// the first NonceSize bytes of HKDF-Expand(PRK=key, info="kht nonce") with
+// SHA-256, where key is the block's derived key. The block's first offset (as
+// a little-endian uint64) is the additional data, so a ciphertext can't be
+// moved to another block. Because the nonce is fixed for each block, sealing
+// different plaintexts as the same block under the same keys reveals their
+// XOR with most AEADs; a block must only be rewritten under a new root key.
+//
+// EncryptBlock returns an *OffsetError if the offset is out of range, ErrNoKey
+// if a tree has no root key, and any error d returns for the block's key.
+func EncryptBlock(d Deriver, aead AEAD, offset uint64, plaintext, dst []byte) ([]byte, error) {
+	if uint64(len(plaintext)) > d.BlockSize() {
+		return nil, errBlockTooLong
+	}
+
+	b := newBlockKeys(d, false)
+	c, nonce, err := b.cipher(aead, offset, true)
+	if err != nil {
+		return nil, err
+	}
+
+	ad := b.ad(offset)
+	return c.Seal(dst, nonce, plaintext, ad[:]), nil
+}
+
+// DecryptBlock opens the given ciphertext, sealed by EncryptBlock as the block
+// containing the given offset, appending the plaintext to dst. It returns an
+// error if the ciphertext isn't authentic, including if it was sealed as a
+// different block or with a different Deriver's keys.
+func DecryptBlock(d Deriver, aead AEAD, offset uint64, ciphertext, dst []byte) ([]byte, error) {
+	b := newBlockKeys(d, false)
+	c, nonce, err := b.cipher(aead, offset, true)
+	if err != nil {
+		return nil, err
+	}
+
+	ad := b.ad(offset)
+	return c.Open(dst, nonce, ciphertext, ad[:])
+}
+
+// SealBlock is like EncryptBlock, but seals the block with a random nonce,
+// which it appends to dst ahead of the ciphertext, so the sealed block is
+// NonceSize bytes longer. Unlike with EncryptBlock, a block can be sealed any
+// number of times under the same keys, since each sealing's nonce is new;
+// with AES-GCM's 12-byte nonces, each block should be sealed no more than 2^32
+// times.
+func SealBlock(d Deriver, aead AEAD, offset uint64, plaintext, dst []byte) ([]byte, error) {
+	if uint64(len(plaintext)) > d.BlockSize() {
+		return nil, errBlockTooLong
+	}
+	return sealBlock(newBlockKeys(d, false), aead, offset, plaintext, dst)
+}
+
+// OpenBlock opens the given sealed block, sealed by SealBlock as the block
+// containing the given offset, appending the plaintext to dst. It returns an
+// error if the sealed block isn't authentic, including if it was sealed as a
+// different block or with a different Deriver's keys. To reuse the sealed
+// block's storage for the plaintext, use sealed[NonceSize:NonceSize] as dst.
+func OpenBlock(d Deriver, aead AEAD, offset uint64, sealed, dst []byte) ([]byte, error) {
+	return openBlock(newBlockKeys(d, false), aead, offset, sealed, dst)
+}
+
+func sealBlock(b *blockKeys, aead AEAD, offset uint64, plaintext, dst []byte) ([]byte, error) {
+	c, _, err := b.cipher(aead, offset, false)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(dst)
+	dst = append(dst, make([]byte, c.NonceSize())...)
+	nonce := dst[n:]
+	_, _ = rand.Read(nonce)
+	ad := b.ad(offset)
+	return c.Seal(dst, nonce, plaintext, ad[:]), nil
+}
+
+func openBlock(b *blockKeys, aead AEAD, offset uint64, sealed, dst []byte) ([]byte, error) {
+	c, _, err := b.cipher(aead, offset, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < c.NonceSize() {
+		return nil, errBlockTooShort
+	}
+	nonce, ciphertext := sealed[:c.NonceSize()], sealed[c.NonceSize():]
+	ad := b.ad(offset)
+	return c.Open(dst, nonce, ciphertext, ad[:])
+}
+
+// blockKeys derives the ciphers and nonces of a Deriver's blocks. A tree's
+// blocks are keyed as with KeyNonce, optionally with a cursor, which reuses the
+// ancestor nodes shared between adjacent blocks; any other Deriver's nonces are
+// expanded from its keys with nonceHash.
+type blockKeys struct {
+	d          Deriver
+	t          *KeyedHashTree // d, if it's a tree
+	c          *cursor        // derives t's leaves, if set
+	blockSize  uint64
+	start, end uint64 // the range of offsets whose blocks are keyed
+}
+
+// newBlockKeys returns a blockKeys for d, which derives a tree's keys with a
+// cursor if sequential is set.
+func newBlockKeys(d Deriver, sequential bool) *blockKeys {
+	b := &blockKeys{d: d, blockSize: d.BlockSize(), end: d.MaxSize()}
+	if t, ok := d.(*KeyedHashTree); ok {
+		b.t, b.start, b.end = t, t.base, t.limit
+		if sequential {
+			b.c = newCursor(t)
+		}
+	}
+	return b
+}
+
+// checkOffset returns an *OffsetError if the given offset is out of range.
+func (b *blockKeys) checkOffset(offset uint64) error {
+	if offset < b.start || offset >= b.end {
+		return &OffsetError{Offset: offset, Base: b.start, MaxSize: b.end}
+	}
+	return nil
+}
+
+// cipher returns the cipher for the block containing the given offset, and the
+// block's nonce if withNonce is set.
+func (b *blockKeys) cipher(aead AEAD, offset uint64, withNonce bool) (cipher.AEAD, []byte, error) {
+	key, prk, alg, err := b.key(offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer Wipe(prk)
+
+	c, err := aead(key)
+	Wipe(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var nonce []byte
+	if withNonce {
+		nonce = expand(alg, prk, nonceInfo, c.NonceSize())
+	}
+	return c, nonce, nil
+}
+
+// key returns the derived key of the block containing the given offset, and
+// the pseudorandom key its nonce is expanded from with alg. The caller must
+// wipe both.
+func (b *blockKeys) key(offset uint64) (key, prk []byte, alg KeyedHash, err error) {
+	if b.t == nil {
+		if err := b.checkOffset(offset); err != nil {
+			return nil, nil, nil, err
+		}
+
+		k, err := b.d.KeyAt(offset)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return k, append([]byte(nil), k...), nonceHash, nil
+	}
+
+	var leaf []byte
+	if b.c != nil {
+		leaf = append([]byte(nil), b.c.leaf(offset)...)
+	} else if b.t.root == nil {
+		return nil, nil, nil, ErrNoKey
+	} else if err := b.t.checkOffset(offset); err != nil {
+		return nil, nil, nil, err
+	} else {
+		leaf = b.t.leaf(offset)
+	}
+	return b.t.output(append([]byte(nil), leaf...)), leaf, b.t.alg, nil
+}
+
+// ad returns the additional data for the block containing the given offset,
+// which is the block's first offset.
+func (b *blockKeys) ad(offset uint64) [8]byte {
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], offset-offset%b.blockSize)
+	return ad
+}
+
+// wipe zeroes the keys held by the cursor, if there is one.
+func (b *blockKeys) wipe() {
+	if b.c != nil {
+		b.c.wipe()
+	}
+}
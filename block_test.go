@@ -0,0 +1,158 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestEncryptBlock(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	plaintext := []byte("a secret block!")
+
+	ct, err := tree.EncryptBlock(kht.AESGCM, 32, plaintext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := tree.EncryptBlock(kht.AESGCM, 40, plaintext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(ct, again) {
+		t.Error("Encryption of the same block was not deterministic")
+	}
+
+	other, err := tree.EncryptBlock(kht.AESGCM, 48, plaintext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(ct, other) {
+		t.Error("Different blocks had the same ciphertext")
+	}
+
+	pt, err := tree.DecryptBlock(kht.AESGCM, 32, ct, []byte("prefix"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := append([]byte("prefix"), plaintext...); !bytes.Equal(pt, want) {
+		t.Errorf("Plaintext was %q, but expected %q", pt, want)
+	}
+
+	if _, err := tree.DecryptBlock(kht.AESGCM, 48, ct, nil); err == nil {
+		t.Error("Opened a ciphertext as the wrong block")
+	}
+
+	ct[0] ^= 1
+	if _, err := tree.DecryptBlock(kht.AESGCM, 32, ct, nil); err == nil {
+		t.Error("Opened a modified ciphertext")
+	}
+}
+
+func TestEncryptBlockInvalid(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+
+	if _, err := tree.EncryptBlock(kht.AESGCM, 0, make([]byte, 17), nil); err == nil {
+		t.Error("Encrypted a plaintext longer than the block size")
+	}
+
+	if _, err := tree.EncryptBlock(kht.AESGCM, 1024, nil, nil); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+
+	if _, err := new(kht.KeyedHashTree).DecryptBlock(kht.AESGCM, 0, nil, nil); !errors.Is(err, kht.ErrNoKey) {
+		t.Errorf("Error was %v, but expected ErrNoKey", err)
+	}
+}
+
+func TestSealBlock(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	plaintext := []byte("a secret block!")
+
+	sealed, err := tree.SealBlock(kht.AESGCM, 32, plaintext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, want := len(sealed), 12+len(plaintext)+16; n != want {
+		t.Errorf("Sealed block was %d bytes, but expected %d", n, want)
+	}
+
+	again, err := tree.SealBlock(kht.AESGCM, 32, plaintext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(sealed[:12], again[:12]) {
+		t.Error("Sealing the same block twice reused a nonce")
+	}
+
+	pt, err := tree.OpenBlock(kht.AESGCM, 40, again, []byte("prefix"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := append([]byte("prefix"), plaintext...); !bytes.Equal(pt, want) {
+		t.Errorf("Plaintext was %q, but expected %q", pt, want)
+	}
+
+	if _, err := tree.OpenBlock(kht.AESGCM, 48, sealed, nil); err == nil {
+		t.Error("Opened a sealed block as the wrong block")
+	}
+
+	if _, err := tree.OpenBlock(kht.AESGCM, 32, sealed[:11], nil); err == nil {
+		t.Error("Opened a truncated sealed block")
+	}
+
+	sealed[0] ^= 1
+	if _, err := tree.OpenBlock(kht.AESGCM, 32, sealed, nil); err == nil {
+		t.Error("Opened a sealed block with a modified nonce")
+	}
+}
+
+func TestKeyNonce(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+
+	key, nonce := tree.KeyNonce(40, 12)
+	if want := tree.Key(40); !bytes.Equal(key, want) {
+		t.Errorf("Key was %#v, but expected %#v", key, want)
+	}
+
+	if len(nonce) != 12 {
+		t.Errorf("Nonce was %d bytes, but expected 12", len(nonce))
+	}
+
+	if _, other := tree.KeyNonce(32, 12); !bytes.Equal(nonce, other) {
+		t.Error("Offsets in the same block had different nonces")
+	}
+
+	if _, other := tree.KeyNonce(48, 12); bytes.Equal(nonce, other) {
+		t.Error("Different blocks had the same nonce")
+	}
+
+	rotated := mustNew(t, []byte("boo"), kht.HMAC(sha256.New), 16, 1024, 4)
+	if _, other := rotated.KeyNonce(40, 12); bytes.Equal(nonce, other) {
+		t.Error("Different root keys had the same nonce")
+	}
+
+	// EncryptBlock uses the same nonce.
+	ct, err := tree.EncryptBlock(kht.AESGCM, 40, []byte("yay"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := kht.AESGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Open(nil, nonce, ct, []byte{32, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Errorf("Couldn't open the block with KeyNonce's key and nonce: %v", err)
+	}
+}
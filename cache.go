@@ -0,0 +1,131 @@
+package kht
+
+import (
+	"container/list"
+	"sync"
+)
+
+// WithNodeCache returns an Option which keeps the keys of up to n recently
+// derived internal nodes in a least-recently-used cache. Deriving a key starts
+// from the deepest cached ancestor of its leaf rather than from the root, so
+// with locality of reference (e.g., sequential scans or hot regions), deriving
+// the key for the block after one just derived costs a single keyed hash
+// rather than one per level. Each entry holds one node key, plus roughly 100
+// bytes of overhead. The cache is disabled by default.
+//
+// Cached keys are secret: anyone who can read the cache can derive every key
+// beneath them. The cache is wiped when the root key changes.
+func WithNodeCache(n int) Option {
+	return func(t *KeyedHashTree) {
+		t.cacheSize = n
+	}
+}
+
+// CacheStats are a tree's node cache statistics.
+type CacheStats struct {
+	Hits      uint64 // the number of derivations which started from a cached node
+	Misses    uint64 // the number of derivations which started from the root
+	Evictions uint64 // the number of keys evicted to make room for others
+	Entries   int    // the number of keys in the cache
+}
+
+// CacheStats returns statistics on the use of the tree's node cache, which are
+// all zero unless the cache is enabled with WithNodeCache.
+func (t *KeyedHashTree) CacheStats() CacheStats {
+	if t.cache == nil {
+		return CacheStats{}
+	}
+
+	t.cache.mu.Lock()
+	defer t.cache.mu.Unlock()
+
+	stats := t.cache.stats
+	stats.Entries = t.cache.lru.Len()
+	return stats
+}
+
+// A nodeID identifies a node by its level and index.
+type nodeID struct {
+	level, index uint64
+}
+
+type cacheEntry struct {
+	id  nodeID
+	key []byte
+}
+
+// A nodeCache is an LRU cache of the keys of internal nodes.
+type nodeCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[nodeID]*list.Element
+	lru     list.List // of *cacheEntry, most recently used first
+	stats   CacheStats
+}
+
+func newNodeCache(size int) *nodeCache {
+	if size <= 0 {
+		return nil
+	}
+
+	return &nodeCache{
+		size:    size,
+		entries: make(map[nodeID]*list.Element, size),
+	}
+}
+
+// ancestor appends the key of the deepest cached node at or above the given
+// level which contains the given offset to dst, returning its level. If there
+// is no such node, it returns the level of the tree's root and dst unchanged.
+func (c *nodeCache) ancestor(t *KeyedHashTree, dst []byte, offset, level uint64) (uint64, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for l := min(level, t.depth-1); l > t.top; l-- {
+		if e, ok := c.entries[nodeID{l, offset / t.sizes[l]}]; ok {
+			c.lru.MoveToFront(e)
+			c.stats.Hits++
+			return l, append(dst, e.Value.(*cacheEntry).key...)
+		}
+	}
+	c.stats.Misses++
+	return t.top, dst
+}
+
+// put adds a copy of the given node key to the cache, evicting the least
+// recently used key if the cache is full.
+func (c *nodeCache) put(id nodeID, key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[id]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	var entry *cacheEntry
+	if c.lru.Len() >= c.size {
+		e := c.lru.Back()
+		entry = c.lru.Remove(e).(*cacheEntry)
+		delete(c.entries, entry.id)
+		c.stats.Evictions++
+	} else {
+		entry = new(cacheEntry)
+	}
+
+	entry.id = id
+	entry.key = append(entry.key[:0], key...)
+	c.entries[id] = c.lru.PushFront(entry)
+}
+
+// wipe zeroes and removes every key in the cache.
+func (c *nodeCache) wipe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		Wipe(e.Value.(*cacheEntry).key)
+	}
+	c.lru.Init()
+	clear(c.entries)
+}
@@ -0,0 +1,77 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestNodeCache(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1<<20, 4)
+	cached := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1<<20, 4, kht.WithNodeCache(16))
+
+	for offset := uint64(0); offset < 4096; offset += 16 {
+		if v, want := cached.Key(offset), tree.Key(offset); !bytes.Equal(v, want) {
+			t.Fatalf("Key for %d was %#v, but expected %#v", offset, v, want)
+		}
+	}
+
+	for _, offset := range []uint64{1 << 19, 12345, 0, 1<<20 - 1} {
+		if v, want := cached.Key(offset), tree.Key(offset); !bytes.Equal(v, want) {
+			t.Errorf("Key for %d was %#v, but expected %#v", offset, v, want)
+		}
+	}
+
+	stats := cached.CacheStats()
+	if stats.Hits+stats.Misses != 260 || stats.Hits < 250 {
+		t.Errorf("Stats were %+v, but expected at least 250 hits out of 260", stats)
+	}
+
+	if stats.Entries != 16 || stats.Evictions == 0 {
+		t.Errorf("Stats were %+v, but expected 16 entries and some evictions", stats)
+	}
+
+	if err := cached.SetKey([]byte("boo")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := cached.CacheStats().Entries; n != 0 {
+		t.Errorf("Cache had %d entries after rekeying, but expected none", n)
+	}
+
+	other := mustNew(t, []byte("boo"), kht.HMAC(sha256.New), 16, 1<<20, 4)
+	if v, want := cached.Key(16), other.Key(16); !bytes.Equal(v, want) {
+		t.Errorf("Key after rekeying was %#v, but expected %#v", v, want)
+	}
+}
+
+func TestNodeCacheSubtree(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1<<20, 4, kht.WithNodeCache(64))
+
+	sub, err := tree.Subtree(2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := uint64(5 << 16)
+	for offset := base; offset < base+1024; offset += 16 {
+		if v, want := sub.Key(offset), tree.Key(offset); !bytes.Equal(v, want) {
+			t.Fatalf("Key for %d was %#v, but expected %#v", offset, v, want)
+		}
+	}
+
+	if stats := sub.CacheStats(); stats.Misses != 1 {
+		t.Errorf("Stats were %+v, but expected 1 miss", stats)
+	}
+}
+
+func BenchmarkKeyNodeCache(b *testing.B) {
+	tree := mustNew(b, []byte("yay"), kht.HMAC(sha256.New), 1024, 1<<40, 16, kht.WithNodeCache(64))
+	b.ReportAllocs()
+
+	for i := 0; b.Loop(); i++ {
+		tree.Key(uint64(i) * 1024 % (1 << 40))
+	}
+}
@@ -0,0 +1,235 @@
+// Command kht derives keys from keyed hash trees, encrypts and decrypts files
+// with them, and exports the node keys which cover ranges of them.
+//
+// Usage:
+//
+//	kht key     -key-file FILE [tree flags] -offset N
+//	kht encrypt -key-file FILE [tree flags] < plaintext > ciphertext
+//	kht decrypt -key-file FILE < ciphertext > plaintext
+//	kht export  -key-file FILE [tree flags] -start N -end N
+//
+// The root key is read from the key file as raw bytes. The tree flags are
+// -hash, -block-size, -max-size, -factor, and -key-length; see kht -h.
+//
+// Encrypted files begin with the tree's parameters (see kht.Params) and a
+// random 16-byte file ID, followed by the ciphertext of each block sealed with
+// AES-GCM, as written by kht.KeyedHashTree.NewEncryptWriter. Each file is
+// encrypted with its own tree, derived from the root key and the file ID (see
+// kht.KeyedHashTree.DeriveTree), so every block of every file is sealed with
+// its own key and nonce (see kht.KeyedHashTree.KeyNonce), and one key file can
+// encrypt any number of files. The header isn't authenticated until the first
+// block is opened, so decrypt rejects block sizes over 16 MiB, as well as the
+// parameters the kht package bounds, before deriving any keys. A file which
+// has been truncated, even at a block boundary, fails to decrypt.
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/codahale/kht"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "kht:", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("usage: kht key|encrypt|decrypt|export [flags]")
+
+// maxBlockSize is the largest block size decrypt accepts from a file's header.
+const maxBlockSize = 16 << 20
+
+// fileIDSize is the length of the random ID which follows a file's parameters.
+const fileIDSize = 16
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	fs := flag.NewFlagSet("kht "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	keyFile := fs.String("key-file", "", "the file containing the root key")
+	hash := fs.String("hash", "HMAC-SHA256", "the registered name of the keyed hash")
+	blockSize := fs.Uint64("block-size", kht.DefaultBlockSize, "the block size, in bytes")
+	maxSize := fs.Uint64("max-size", kht.DefaultMaxSize, "the maximum size, in bytes")
+	factor := fs.Uint64("factor", kht.DefaultFactor, "the branching factor")
+	keyLength := fs.Int("key-length", 0, "the length of derived keys, if not the hash size")
+	offset := fs.Uint64("offset", 0, "the offset of the key to derive")
+	start := fs.Uint64("start", 0, "the first offset of the range to export")
+	end := fs.Uint64("end", 0, "the end of the range to export")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *keyFile == "" {
+		return errors.New("-key-file is required")
+	}
+
+	key, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	defer kht.Wipe(key)
+
+	params := kht.Params{
+		Hash:      *hash,
+		BlockSize: *blockSize,
+		MaxSize:   *maxSize,
+		Factor:    *factor,
+		KeyLength: *keyLength,
+	}
+
+	switch args[0] {
+	case "key":
+		return deriveKey(stdout, key, params, *offset)
+	case "encrypt":
+		return encrypt(stdout, stdin, key, params)
+	case "decrypt":
+		return decrypt(stdout, stdin, key)
+	case "export":
+		return export(stdout, key, params, *start, *end)
+	default:
+		return errUsage
+	}
+}
+
+// deriveKey prints the hex-encoded key at the given offset.
+func deriveKey(w io.Writer, key []byte, params kht.Params, offset uint64) error {
+	tree, err := kht.FromParams(key, params)
+	if err != nil {
+		return err
+	}
+	defer tree.Wipe()
+
+	k, err := tree.KeyAt(offset)
+	if err != nil {
+		return err
+	}
+	defer kht.Wipe(k)
+
+	_, err = fmt.Fprintln(w, hex.EncodeToString(k))
+	return err
+}
+
+// encrypt writes the tree's parameters, a random file ID, and the contents of
+// r, encrypted with the file's tree, to w.
+func encrypt(w io.Writer, r io.Reader, key []byte, params kht.Params) error {
+	header, err := params.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, fileIDSize)
+	_, _ = rand.Read(id)
+	header = append(header, id...)
+
+	tree, err := fileTree(key, params, id)
+	if err != nil {
+		return err
+	}
+	defer tree.Wipe()
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	ew := tree.NewEncryptWriter(bw, kht.AESGCM)
+	if _, err := io.Copy(ew, r); err != nil {
+		return err
+	}
+
+	if err := ew.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// decrypt reads the tree's parameters and the file ID from r, and writes the
+// decrypted contents of the rest of r to w.
+func decrypt(w io.Writer, r io.Reader, key []byte) error {
+	br := bufio.NewReader(r)
+	params, err := kht.ReadParams(br)
+	if err != nil {
+		return err
+	}
+
+	if params.BlockSize > maxBlockSize {
+		return fmt.Errorf("block size of %d bytes is too large", params.BlockSize)
+	}
+
+	id := make([]byte, fileIDSize)
+	if _, err := io.ReadFull(br, id); err != nil {
+		return errors.New("file ID is missing")
+	}
+
+	tree, err := fileTree(key, params, id)
+	if err != nil {
+		return err
+	}
+	defer tree.Wipe()
+
+	_, err = io.Copy(w, tree.NewDecryptReader(br, kht.AESGCM))
+	return err
+}
+
+// fileTree returns the tree for the file with the given ID, derived from the
+// tree with the given root key and parameters.
+func fileTree(key []byte, params kht.Params, id []byte) (*kht.KeyedHashTree, error) {
+	root, err := kht.FromParams(key, params)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Wipe()
+
+	return root.DeriveTree(id)
+}
+
+type exportedNode struct {
+	Level uint64 `json:"level"`
+	Index uint64 `json:"index"`
+	Key   string `json:"key"`
+}
+
+type exported struct {
+	Params kht.Params     `json:"params"`
+	Nodes  []exportedNode `json:"nodes"`
+}
+
+// export prints the tree's parameters and the hex-encoded keys of the nodes
+// which cover the range [start, end) as JSON.
+func export(w io.Writer, key []byte, params kht.Params, start, end uint64) error {
+	tree, err := kht.FromParams(key, params)
+	if err != nil {
+		return err
+	}
+	defer tree.Wipe()
+
+	nodes, err := tree.RangeCover(start, end)
+	if err != nil {
+		return err
+	}
+
+	out := exported{Params: params, Nodes: make([]exportedNode, len(nodes))}
+	for i, n := range nodes {
+		out.Nodes[i] = exportedNode{Level: n.Level, Index: n.Index, Key: hex.EncodeToString(n.Key)}
+		kht.Wipe(n.Key)
+	}
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(&out)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func keyFile(t *testing.T) string {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(name, []byte("a secret root key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestKey(t *testing.T) {
+	out := new(bytes.Buffer)
+	if err := run([]string{"key", "-key-file", keyFile(t), "-block-size", "16", "-max-size", "1024",
+		"-factor", "4", "-offset", "100"}, nil, out, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := kht.NewInt([]byte("a secret root key"), kht.HMAC(sha256.New), 16, 1024, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := strings.TrimSpace(out.String()), hex.EncodeToString(tree.Key(100)); v != want {
+		t.Errorf("Key was %s, but expected %s", v, want)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := keyFile(t)
+	plaintext := bytes.Repeat([]byte("a sensitive block of data "), 100)
+
+	ct := new(bytes.Buffer)
+	if err := run([]string{"encrypt", "-key-file", key, "-block-size", "64"},
+		bytes.NewReader(plaintext), ct, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(ct.Bytes(), []byte("sensitive")) {
+		t.Error("Ciphertext contains the plaintext")
+	}
+
+	pt := new(bytes.Buffer)
+	if err := run([]string{"decrypt", "-key-file", key}, ct, pt, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(pt.Bytes(), plaintext) {
+		t.Errorf("Plaintext was %q, but expected %q", pt.Bytes(), plaintext)
+	}
+}
+
+func TestEncryptFileIDs(t *testing.T) {
+	key := keyFile(t)
+	plaintext := bytes.Repeat([]byte("a sensitive block of data "), 10)
+
+	var cts [2][]byte
+	for i := range cts {
+		ct := new(bytes.Buffer)
+		if err := run([]string{"encrypt", "-key-file", key, "-block-size", "64"},
+			bytes.NewReader(plaintext), ct, new(bytes.Buffer)); err != nil {
+			t.Fatal(err)
+		}
+		cts[i] = ct.Bytes()
+	}
+
+	// The files share a key file and parameters, but not their blocks' keys.
+	header, err := kht.Params{Hash: "HMAC-SHA256", BlockSize: 64, MaxSize: kht.DefaultMaxSize,
+		Factor: kht.DefaultFactor}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(cts[0], header) || !bytes.HasPrefix(cts[1], header) {
+		t.Fatal("Files don't begin with the parameters")
+	}
+
+	a, b := cts[0][len(header):], cts[1][len(header):]
+	if bytes.Equal(a[:16], b[:16]) {
+		t.Error("Files have the same ID")
+	}
+
+	if bytes.Equal(a[16:16+64+16], b[16:16+64+16]) {
+		t.Error("Files have the same first block")
+	}
+
+	tampered := bytes.Clone(cts[0])
+	tampered[len(header)] ^= 1
+	if err := run([]string{"decrypt", "-key-file", key}, bytes.NewReader(tampered), new(bytes.Buffer),
+		new(bytes.Buffer)); err == nil {
+		t.Error("Decrypted a file with a tampered ID")
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	key := keyFile(t)
+
+	ct := new(bytes.Buffer)
+	if err := run([]string{"encrypt", "-key-file", key, "-block-size", "64"},
+		bytes.NewReader(make([]byte, 640)), ct, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop the final block, leaving the file cut at a block boundary.
+	truncated := ct.Bytes()[:ct.Len()-(64+16)]
+	if err := run([]string{"decrypt", "-key-file", key}, bytes.NewReader(truncated), new(bytes.Buffer),
+		new(bytes.Buffer)); err == nil {
+		t.Error("Decrypted a truncated file")
+	}
+}
+
+func TestDecryptUntrustedHeader(t *testing.T) {
+	key := keyFile(t)
+
+	big, err := kht.Params{Hash: "HMAC-SHA256", BlockSize: 1 << 40, MaxSize: 1 << 50, Factor: 4}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A header whose Argon2 memory has been raised past the maximum. The
+	// encoding ends with the memory, threads, and salt, and the memory is a
+	// single byte here.
+	tree, err := kht.NewFromPassphrase([]byte("yay"), []byte("0123456789abcdef"),
+		kht.Argon2Params{Time: 1, Memory: 64, Threads: 1}, kht.HMAC(sha256.New), 64, 1<<20, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := len(enc) - 16 - 3
+	enc = append(binary.AppendUvarint(enc[:i:i], math.MaxUint32), enc[i+1:]...)
+	costly := binary.AppendUvarint([]byte("KHT\x00"), uint64(len(enc)))
+	costly = append(costly, enc...)
+
+	for name, header := range map[string][]byte{"block size": big, "Argon2 memory": costly} {
+		if err := run([]string{"decrypt", "-key-file", key}, bytes.NewReader(header), new(bytes.Buffer),
+			new(bytes.Buffer)); err == nil {
+			t.Errorf("Decrypted a file with an unbounded %s", name)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	out := new(bytes.Buffer)
+	if err := run([]string{"export", "-key-file", keyFile(t), "-block-size", "16", "-max-size", "1024",
+		"-factor", "4", "-start", "0", "-end", "256"}, nil, out, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	var e exported
+	if err := json.Unmarshal(out.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(e.Nodes) != 1 || e.Nodes[0].Level != 1 || e.Nodes[0].Index != 0 {
+		t.Fatalf("Nodes were %+v, but expected (1, 0)", e.Nodes)
+	}
+
+	tree, err := kht.NewInt([]byte("a secret root key"), kht.HMAC(sha256.New), 16, 1024, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := tree.NodeKey(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := e.Nodes[0].Key; v != hex.EncodeToString(want) {
+		t.Errorf("Node key was %s, but expected %x", v, want)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	if err := run(nil, nil, new(bytes.Buffer), new(bytes.Buffer)); err != errUsage {
+		t.Errorf("Error was %v, but expected %v", err, errUsage)
+	}
+
+	if err := run([]string{"key"}, nil, new(bytes.Buffer), new(bytes.Buffer)); err == nil {
+		t.Error("No error without a key file, but expected one")
+	}
+}
@@ -0,0 +1,192 @@
+package kht
+
+import (
+	"cmp"
+	"encoding/binary"
+	"iter"
+	"slices"
+	"time"
+)
+
+// A cursor derives leaf keys for a sequence of offsets, keeping the keys of the
+// most recently derived path through the tree. Deriving the key for an offset
+// only recomputes the nodes which aren't shared with the previous offset, so a
+// sequential scan costs roughly one keyed hash per block rather than one per
+// level per block.
+type cursor struct {
+	t     *KeyedHashTree
+	keys  [][]byte // keys[i] is the key of the node at level i
+	index []uint64 // index[i] is the index of the node at level i
+	valid uint64   // the deepest level in keys and index
+	buf   [16]byte
+}
+
+func newCursor(t *KeyedHashTree) *cursor {
+	c := &cursor{
+		t:     t,
+		keys:  make([][]byte, t.depth+1),
+		index: make([]uint64, t.depth+1),
+	}
+	c.keys[t.top] = t.root
+	c.valid = t.top
+	return c
+}
+
+// leaf returns the key of the leaf node containing the given offset. The
+// returned slice is only valid until the next call to leaf.
+func (c *cursor) leaf(offset uint64) []byte {
+	if c.t.root == nil {
+		panic("tree has no key")
+	}
+
+	if c.t.checkOffset(offset) != nil {
+		panic("offset greater than maximum size")
+	}
+
+	var began time.Time
+	if c.t.observer != nil {
+		began = time.Now()
+	}
+
+	var hashes uint64
+	for i := c.t.top; i < c.t.depth; i++ {
+		level := i + 1
+		y := offset / c.t.nodeSize(level)
+		if level <= c.valid && c.index[level] == y {
+			continue
+		}
+		hashes++
+
+		binary.LittleEndian.PutUint64(c.buf[:], i)
+		binary.LittleEndian.PutUint64(c.buf[8:], y)
+
+		h := c.t.alg(c.keys[i])
+		_, _ = h.Write(c.buf[:])
+		c.keys[level] = h.Sum(c.keys[level][:0])
+		wipeHash(h)
+		c.index[level] = y
+		c.valid = level
+	}
+
+	if c.t.observer != nil {
+		c.t.observe(Derivation{Offset: offset, Level: c.t.depth, Nodes: 1, Hashes: hashes}, began)
+	}
+	return c.keys[c.t.depth]
+}
+
+// wipe zeroes the keys of every node below the cursor's root.
+func (c *cursor) wipe() {
+	for _, k := range c.keys[c.t.top+1:] {
+		Wipe(k)
+	}
+}
+
+// key returns the derived key at the given offset.
+func (c *cursor) key(offset uint64) []byte {
+	k := c.leaf(offset)
+	return c.t.output(append([]byte(nil), k...))
+}
+
+// Keys returns the derived keys of count consecutive blocks, starting with the
+// block containing the given offset, such that Keys(offset, 1)[0] is equal to
+// Key(offset). The path through the tree is derived once, and only the nodes
+// which change from one block to the next are recomputed, so deriving the keys
+// for every block in a tree costs one keyed hash per node rather than one per
+// level per block. With WithBatchHash, the blocks are derived a level at a
+// time instead. It panics if any of the blocks are past the tree's covered
+// size.
+func (t *KeyedHashTree) Keys(offset, count uint64) [][]byte {
+	if t.batch != nil && count > 0 {
+		return t.batchKeys(offset, count)
+	}
+
+	c := newCursor(t)
+	defer c.wipe()
+
+	keys := make([][]byte, count)
+	end := t.end()
+	for i := range keys {
+		keys[i] = c.key(offset)
+		if end-offset < t.blockSize && i < len(keys)-1 {
+			panic("offset greater than maximum size") // the next offset would wrap
+		}
+		offset += t.blockSize
+	}
+	return keys
+}
+
+// KeysAt returns the derived keys at the given offsets, in the same order, such
+// that KeysAt(offsets)[i] is equal to Key(offsets[i]). The offsets are derived
+// in sorted order, reusing the ancestor nodes shared between them, so deriving
+// many keys in the same region of the tree costs little more than one keyed
+// hash each. It returns an *OffsetError for the first offset which is out of
+// range, without deriving any keys, and ErrNoKey if the tree has no root key.
+func (t *KeyedHashTree) KeysAt(offsets []uint64) ([][]byte, error) {
+	if t.root == nil {
+		return nil, ErrNoKey
+	}
+
+	for _, offset := range offsets {
+		if err := t.checkOffset(offset); err != nil {
+			return nil, err
+		}
+	}
+
+	order := make([]int, len(offsets))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Compare(offsets[a], offsets[b])
+	})
+
+	c := newCursor(t)
+	defer c.wipe()
+
+	keys := make([][]byte, len(offsets))
+	for _, i := range order {
+		keys[i] = c.key(offsets[i])
+	}
+	return keys, nil
+}
+
+// KeysRange returns the derived keys of the blocks containing the bytes in
+// [start, end), in offset order, such that KeysRange(start, end)[0] is equal to
+// Key(start). It returns an *OffsetError if the range isn't within the tree,
+// and ErrNoKey if the tree has no root key.
+func (t *KeyedHashTree) KeysRange(start, end uint64) ([][]byte, error) {
+	if t.root == nil {
+		return nil, ErrNoKey
+	}
+
+	if start >= end {
+		return nil, nil
+	}
+
+	if err := t.checkOffset(start); err != nil {
+		return nil, err
+	}
+
+	if err := t.checkOffset(end - 1); err != nil {
+		return nil, err
+	}
+	return t.Keys(start, (end-1)/t.blockSize-start/t.blockSize+1), nil
+}
+
+// AllKeys returns an iterator over the offset and derived key of every full
+// block in the tree, in offset order, stopping at the last full block within
+// MaxSize. Like Keys, it reuses the ancestor nodes shared between adjacent
+// blocks. Breaking out of the loop stops derivation.
+func (t *KeyedHashTree) AllKeys() iter.Seq2[uint64, []byte] {
+	return func(yield func(uint64, []byte) bool) {
+		c := newCursor(t)
+		defer c.wipe()
+
+		end := t.MaxSize()
+		for offset := t.base; end-offset >= t.blockSize; offset += t.blockSize {
+			if !yield(offset, c.key(offset)) {
+				return
+			}
+		}
+	}
+}
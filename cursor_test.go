@@ -0,0 +1,209 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"hash"
+	"math"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestKeys(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 256, 4)
+
+	keys := tree.Keys(0, 128)
+	for i, k := range keys {
+		if want := tree.Key(uint64(i) * 2); !bytes.Equal(k, want) {
+			t.Errorf("Key %d was %#v, but expected %#v", i, k, want)
+		}
+	}
+
+	for i := uint64(0); i < 512; i++ {
+		if v, want := tree.Keys(i, 1)[0], tree.Key(i); !bytes.Equal(v, want) {
+			t.Errorf("Key %d was %#v, but expected %#v", i, v, want)
+		}
+	}
+}
+
+func TestKeysSaturated(t *testing.T) {
+	// The tree covers every offset, and its last block is a single byte.
+	tree, err := kht.NewWithDepth([]byte("yay"), kht.HMAC(md5.New), 7, 1000, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := tree.Keys(math.MaxUint64-8, 2)
+	for i, offset := range []uint64{math.MaxUint64 - 8, math.MaxUint64 - 1} {
+		if want := tree.Key(offset); !bytes.Equal(keys[i], want) {
+			t.Errorf("Key %d was %#v, but expected %#v", offset, keys[i], want)
+		}
+	}
+
+	defer func() {
+		e := recover()
+		if e != "offset greater than maximum size" {
+			t.Errorf("Panic was %v, which is weird", e)
+		}
+	}()
+
+	tree.Keys(math.MaxUint64-1, 2)
+	t.Error("No panic, but expected one")
+}
+
+func TestKeysSharesNodes(t *testing.T) {
+	n := 0
+	alg := func(key []byte) hash.Hash {
+		n++
+		return kht.HMAC(md5.New)(key)
+	}
+
+	tree := mustNew(t, []byte("yay"), alg, 1, 64, 4)
+	n = 0
+	tree.Keys(0, 64)
+
+	// 4 nodes at level 1, 16 at level 2, and 64 leaves.
+	if n != 84 {
+		t.Errorf("Derived %d nodes, but expected 84", n)
+	}
+}
+
+// resetHash counts the number of times it's reset.
+type resetHash struct {
+	hash.Hash
+	resets *int
+}
+
+func (h resetHash) Reset() {
+	*h.resets++
+	h.Hash.Reset()
+}
+
+func TestKeysWipesHashes(t *testing.T) {
+	created, resets := 0, 0
+	alg := func(key []byte) hash.Hash {
+		created++
+		return resetHash{Hash: kht.HMAC(md5.New)(key), resets: &resets}
+	}
+
+	tree := mustNew(t, []byte("yay"), alg, 1, 64, 4)
+	created, resets = 0, 0
+	tree.Keys(0, 64)
+
+	if resets != created {
+		t.Errorf("Wiped %d of %d keyed hashes", resets, created)
+	}
+}
+
+func TestAllKeys(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 17, 4)
+
+	want := uint64(0)
+	for offset, k := range tree.AllKeys() {
+		if offset != want {
+			t.Errorf("Offset was %d, but expected %d", offset, want)
+		}
+
+		if v := tree.Key(offset); !bytes.Equal(k, v) {
+			t.Errorf("Key %d was %#v, but expected %#v", offset, k, v)
+		}
+		want += 2
+	}
+
+	if want != 16 {
+		t.Errorf("Iterated up to %d, but expected 16", want)
+	}
+
+	sub, err := tree.Subtree(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for offset := range sub.AllKeys() {
+		if offset < 8 || offset >= 16 {
+			t.Errorf("Offset %d is outside of the subtree", offset)
+		}
+		n++
+
+		if n == 3 {
+			break
+		}
+	}
+
+	if n != 3 {
+		t.Errorf("Iterated over %d keys, but expected 3", n)
+	}
+
+	for _, index := range []uint64{2, 3} {
+		past, err := tree.Subtree(1, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for offset := range past.AllKeys() {
+			t.Errorf("Offset %d is past the maximum size", offset)
+		}
+	}
+}
+
+func TestKeysAt(t *testing.T) {
+	n := 0
+	alg := func(key []byte) hash.Hash {
+		n++
+		return kht.HMAC(md5.New)(key)
+	}
+
+	tree := mustNew(t, []byte("yay"), alg, 1, 64, 4)
+	offsets := []uint64{63, 0, 17, 1, 63, 16, 2}
+
+	n = 0
+	keys, err := tree.KeysAt(offsets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nodes (1,0), (2,0), (1,1), (2,4), (1,3), (2,15), and 6 distinct leaves.
+	if n != 12 {
+		t.Errorf("Derived %d nodes, but expected 12", n)
+	}
+
+	for i, offset := range offsets {
+		if want := tree.Key(offset); !bytes.Equal(keys[i], want) {
+			t.Errorf("Key %d was %#v, but expected %#v", offset, keys[i], want)
+		}
+	}
+
+	if _, err := tree.KeysAt([]uint64{0, 64}); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+}
+
+func TestKeysRange(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 256, 4)
+
+	keys, err := tree.KeysRange(3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 4 {
+		t.Fatalf("Returned %d keys, but expected 4", len(keys))
+	}
+
+	for i, k := range keys {
+		if want := tree.Key(uint64(2 + 2*i)); !bytes.Equal(k, want) {
+			t.Errorf("Key %d was %#v, but expected %#v", i, k, want)
+		}
+	}
+
+	if keys, err := tree.KeysRange(10, 10); err != nil || len(keys) != 0 {
+		t.Errorf("Empty range returned (%v, %v), but expected no keys", keys, err)
+	}
+
+	if _, err := tree.KeysRange(500, 513); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+}
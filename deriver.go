@@ -0,0 +1,152 @@
+package kht
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// A Deriver derives a key for each block of an object. KeyedHashTree is the
+// package's Deriver, and CounterKDF is a flat alternative. Code which only
+// needs blocks' keys can be written against Deriver, so the scheme can be
+// swapped, or derivation mocked in tests; the block encryption helpers (e.g.,
+// EncryptBlock, NewEncryptWriter, and NewReaderAt) all accept one.
+type Deriver interface {
+	// KeyAt returns the derived key at the given offset, or an error if the
+	// key can't be derived. It's the error-returning form of
+	// KeyedHashTree.Key, which panics instead.
+	KeyAt(offset uint64) ([]byte, error)
+
+	// BlockSize returns the number of bytes each key covers.
+	BlockSize() uint64
+
+	// MaxSize returns the size of the largest object whose blocks can be
+	// keyed: KeyAt returns a key for every offset less than it.
+	MaxSize() uint64
+}
+
+var (
+	_ Deriver = (*KeyedHashTree)(nil)
+	_ Deriver = (*CounterKDF)(nil)
+)
+
+// BlockSize returns the number of bytes covered by each of the tree's leaves.
+func (t *KeyedHashTree) BlockSize() uint64 {
+	return t.blockSize
+}
+
+// MaxSize returns the maximum size the tree was created with or grown to, or,
+// for a subtree, the end of the subtree's range if that's less. Keys can also
+// be derived past it, up to CoveredSize.
+func (t *KeyedHashTree) MaxSize() uint64 {
+	return max(min(t.limit, t.maxSize), t.base)
+}
+
+var counterLabel = []byte("kht counter")
+
+// A CounterKDF derives the key of each block directly from a root key with a
+// keyed hash in counter mode, as in NIST SP 800-108: the key of block i is
+// H(root, le64(i) || "kht counter"), where le64(i) is the block's index as a
+// little-endian uint64. Every key costs a single keyed hash, regardless of the
+// object's size, but unlike a KeyedHashTree the keys of a range of blocks
+// can't be delegated without handing out the root key. A CounterKDF is safe
+// for concurrent use.
+type CounterKDF struct {
+	root      []byte
+	alg       KeyedHash
+	blockSize uint64
+	maxSize   uint64
+	limit     uint64
+	size      int
+}
+
+// NewCounterKDF returns a CounterKDF with the given root key, keyed hash, block
+// size, and maximum size, which is rounded up to a multiple of the block size.
+// It returns an error if the key is empty, the keyed hash is nil, the block
+// size is zero, or the maximum size is less than the block size.
+func NewCounterKDF(key []byte, alg KeyedHash, blockSize, maxSize uint64) (*CounterKDF, error) {
+	if len(key) == 0 {
+		return nil, errors.New("kht: key must not be empty")
+	}
+
+	if alg == nil {
+		return nil, errors.New("kht: alg must not be nil")
+	}
+
+	if blockSize == 0 {
+		return nil, errors.New("kht: blockSize must be greater than zero")
+	}
+
+	if maxSize < blockSize {
+		return nil, errors.New("kht: maxSize must not be less than blockSize")
+	}
+
+	limit := maxSize
+	if r := maxSize % blockSize; r != 0 {
+		limit = maxSize + (blockSize - r)
+		if limit < maxSize {
+			limit = math.MaxUint64
+		}
+	}
+
+	return &CounterKDF{
+		root:      append([]byte(nil), key...),
+		alg:       alg,
+		blockSize: blockSize,
+		maxSize:   maxSize,
+		limit:     limit,
+		size:      alg(probeKey).Size(),
+	}, nil
+}
+
+// KeyAt returns the derived key at the given offset, or an *OffsetError if the
+// offset is not less than the covered size. It returns ErrNoKey if the KDF has
+// been wiped.
+func (c *CounterKDF) KeyAt(offset uint64) ([]byte, error) {
+	if c.root == nil {
+		return nil, ErrNoKey
+	}
+
+	if offset >= c.limit {
+		return nil, &OffsetError{Offset: offset, MaxSize: c.limit}
+	}
+
+	var msg [8]byte
+	binary.LittleEndian.PutUint64(msg[:], offset/c.blockSize)
+
+	h := c.alg(c.root)
+	defer wipeHash(h)
+
+	_, _ = h.Write(msg[:])
+	_, _ = h.Write(counterLabel)
+	return h.Sum(nil), nil
+}
+
+// BlockSize returns the number of bytes each key covers.
+func (c *CounterKDF) BlockSize() uint64 {
+	return c.blockSize
+}
+
+// MaxSize returns the maximum size the KDF was created with.
+func (c *CounterKDF) MaxSize() uint64 {
+	return c.maxSize
+}
+
+// CoveredSize returns the maximum size, rounded up to a multiple of the block
+// size, saturating at the largest uint64.
+func (c *CounterKDF) CoveredSize() uint64 {
+	return c.limit
+}
+
+// Size returns the length of the derived keys, which is the output size of the
+// keyed hash.
+func (c *CounterKDF) Size() uint64 {
+	return uint64(c.size)
+}
+
+// Wipe zeroes the KDF's copy of its root key, after which it can't derive
+// keys.
+func (c *CounterKDF) Wipe() {
+	Wipe(c.root)
+	c.root = nil
+}
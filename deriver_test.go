@@ -0,0 +1,177 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+// blockKeys returns the key of every block within d's maximum size.
+func blockKeys(t *testing.T, d kht.Deriver) [][]byte {
+	t.Helper()
+
+	var keys [][]byte
+	for offset := uint64(0); offset < d.MaxSize(); offset += d.BlockSize() {
+		k, err := d.KeyAt(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(k) != sha256.Size {
+			t.Errorf("Key was %d bytes long, but expected %d", len(k), sha256.Size)
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestDeriver(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 256, 4)
+	kdf, err := kht.NewCounterKDF([]byte("yay"), kht.HMAC(sha256.New), 16, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []kht.Deriver{tree, kdf} {
+		keys := blockKeys(t, d)
+		if len(keys) != 16 {
+			t.Errorf("Derived %d keys, but expected 16", len(keys))
+		}
+
+		var oe *kht.OffsetError
+		if _, err := d.KeyAt(256); !errors.As(err, &oe) {
+			t.Errorf("Error was %v, but expected an *OffsetError", err)
+		}
+	}
+}
+
+func TestCounterKDF(t *testing.T) {
+	kdf, err := kht.NewCounterKDF([]byte("yay"), kht.HMAC(sha256.New), 16, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg [8]byte
+	binary.LittleEndian.PutUint64(msg[:], 5)
+	h := hmac.New(sha256.New, []byte("yay"))
+	_, _ = h.Write(msg[:])
+	_, _ = h.Write([]byte("kht counter"))
+
+	k, err := kdf.KeyAt(5*16 + 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := h.Sum(nil); !bytes.Equal(k, want) {
+		t.Errorf("Key was %#v, but expected %#v", k, want)
+	}
+
+	kdf.Wipe()
+	if _, err := kdf.KeyAt(0); err != kht.ErrNoKey {
+		t.Errorf("Error was %v, but expected ErrNoKey", err)
+	}
+
+	if _, err := kht.NewCounterKDF([]byte("yay"), kht.HMAC(sha256.New), 16, 8); err == nil {
+		t.Error("Created a KDF with a maximum size less than the block size")
+	}
+}
+
+func TestCounterKDFEncryption(t *testing.T) {
+	kdf, err := kht.NewCounterKDF([]byte("yay"), kht.HMAC(sha256.New), 16, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte("abcdefghij"), 10)
+
+	// Blocks are sealed with the KDF's keys and nonces expanded from them.
+	ct, err := kht.EncryptBlock(kdf, kht.AESGCM, 40, plaintext[:16], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := kdf.KeyAt(40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce, err := hkdf.Expand(sha256.New, k, "kht nonce", 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := aes.NewCipher(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gcm, err := cipher.NewGCM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := gcm.Seal(nil, nonce, plaintext[:16], binary.LittleEndian.AppendUint64(nil, 32)); !bytes.Equal(ct, want) {
+		t.Errorf("Ciphertext was %x, but expected %x", ct, want)
+	}
+
+	if pt, err := kht.DecryptBlock(kdf, kht.AESGCM, 32, ct, nil); err != nil || !bytes.Equal(pt, plaintext[:16]) {
+		t.Errorf("Decrypted %q, %v", pt, err)
+	}
+
+	if _, err := kht.EncryptBlock(kdf, kht.AESGCM, 250, nil, nil); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+
+	// Streams round-trip.
+	buf := new(bytes.Buffer)
+	w := kht.NewEncryptWriter(kdf, buf, kht.AESGCM)
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pt, err := io.ReadAll(kht.NewDecryptReader(kdf, buf, kht.AESGCM))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(pt, plaintext) {
+		t.Errorf("Stream plaintext was %q, but expected %q", pt, plaintext)
+	}
+
+	// So do files.
+	f := new(memFile)
+	wa, err := kht.NewWriterAt(f, kdf, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := wa.WriteAt(plaintext, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ra, err := kht.NewReaderAt(f, kdf, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 30)
+	if _, err := ra.ReadAt(got, 35); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := plaintext[35:65]; !bytes.Equal(got, want) {
+		t.Errorf("Read %q, but expected %q", got, want)
+	}
+}
@@ -0,0 +1,241 @@
+package kht
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+var (
+	// exportMagic begins every sealed range export.
+	exportMagic = []byte("KHT\x01")
+	exportInfo  = "kht export"
+
+	errInvalidExport = errors.New("kht: invalid range export")
+)
+
+// ExportRange seals the keys for the blocks containing the bytes in [start,
+// end) to the given X25519 public key, so that only the holder of the matching
+// private key can derive them (see ImportRange). The export holds the tree's
+// parameters and the smallest set of nodes which covers the range (see
+// RangeCover), never the root key.
+//
+// The export is sealed as age does: an ephemeral X25519 key is agreed with the
+// recipient's, and the shared secret is run through HKDF-SHA256, with the
+// ephemeral and recipient public keys as the salt and "kht export" as the
+// info, to produce a single-use AES-256-GCM key. The export is the magic bytes
+// "KHT\x01", the ephemeral public key, and the sealed nodes.
+//
+// ExportRange returns an error if the recipient's key isn't an X25519 key or
+// the tree has no parameters (see Params), ErrOffsetOutOfRange if the range
+// isn't within the tree, and ErrNoKey if the tree has no root key.
+func (t *KeyedHashTree) ExportRange(start, end uint64, recipient *ecdh.PublicKey) ([]byte, error) {
+	if recipient.Curve() != ecdh.X25519() {
+		return nil, errors.New("kht: recipient must be an X25519 key")
+	}
+
+	params, err := t.Params()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := t.RangeCover(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nodes) == 0 {
+		return nil, errors.New("kht: can't export an empty range")
+	}
+
+	b, err := params.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(nodes)))
+	for _, n := range nodes {
+		b = binary.AppendUvarint(b, n.Level)
+		b = binary.AppendUvarint(b, n.Index)
+		b = appendBytes(b, n.Key)
+		Wipe(n.Key)
+	}
+	defer Wipe(b)
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(slices.Clone(exportMagic), ephemeral.PublicKey().Bytes()...)
+	aead, err := exportCipher(shared, header[len(exportMagic):], recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, make([]byte, aead.NonceSize()), b, header), nil
+}
+
+// A RangeTree derives the keys of a range of blocks, and no others, from the
+// nodes which cover it. It's the recipient's side of ExportRange.
+type RangeTree struct {
+	start, end uint64
+	trees      []*KeyedHashTree // one per node, in offset order
+}
+
+// ImportRange opens a range export sealed by ExportRange with the given X25519
+// private key, returning a tree which derives the same keys as the exporting
+// tree for every block in the range, and returns errors for all other offsets.
+// It returns an error if the export wasn't sealed to the private key's public
+// key, has been modified, or is invalid.
+func ImportRange(data []byte, identity *ecdh.PrivateKey) (*RangeTree, error) {
+	if identity.Curve() != ecdh.X25519() {
+		return nil, errors.New("kht: identity must be an X25519 key")
+	}
+
+	headerLen := len(exportMagic) + 32 // the magic and the ephemeral public key
+	if len(data) < headerLen || !bytes.Equal(data[:len(exportMagic)], exportMagic) {
+		return nil, errInvalidExport
+	}
+
+	header := data[:headerLen]
+	ephemeral, err := ecdh.X25519().NewPublicKey(header[len(exportMagic):])
+	if err != nil {
+		return nil, errInvalidExport
+	}
+
+	shared, err := identity.ECDH(ephemeral)
+	if err != nil {
+		return nil, errInvalidExport
+	}
+
+	aead, err := exportCipher(shared, ephemeral.Bytes(), identity.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := aead.Open(nil, make([]byte, aead.NonceSize()), data[headerLen:], header)
+	if err != nil {
+		return nil, errors.New("kht: range export can't be opened")
+	}
+	defer Wipe(b)
+
+	r := bytes.NewReader(b)
+	params, err := ReadParams(r)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := params.tree()
+	if err != nil {
+		return nil, err
+	}
+
+	d := decoder{data: b[len(b)-r.Len():]}
+	count := d.uvarint()
+	if d.err != nil || count == 0 || count > uint64(len(d.data)) {
+		return nil, errInvalidExport
+	}
+
+	rt := new(RangeTree)
+	for range count {
+		n := Node{Level: d.uvarint(), Index: d.uvarint(), Key: d.bytes()}
+		if d.err != nil {
+			rt.Wipe()
+			return nil, errInvalidExport
+		}
+
+		tree, err := template.NodeTree(n)
+		if err != nil {
+			rt.Wipe()
+			return nil, err
+		}
+		rt.trees = append(rt.trees, tree)
+	}
+
+	if len(d.data) != 0 {
+		rt.Wipe()
+		return nil, errInvalidExport
+	}
+
+	slices.SortFunc(rt.trees, func(a, b *KeyedHashTree) int {
+		return cmp.Compare(a.base, b.base)
+	})
+	for i := 1; i < len(rt.trees); i++ {
+		if rt.trees[i].base != rt.trees[i-1].limit {
+			rt.Wipe()
+			return nil, errInvalidExport // the nodes must be adjacent
+		}
+	}
+	rt.start, rt.end = rt.trees[0].base, rt.trees[len(rt.trees)-1].limit
+	return rt, nil
+}
+
+// Range returns the range of offsets [start, end) whose keys the tree can
+// derive.
+func (r *RangeTree) Range() (start, end uint64) {
+	return r.start, r.end
+}
+
+// KeyAt returns the derived key at the given offset, or an *OffsetError if the
+// offset is outside the tree's range.
+func (r *RangeTree) KeyAt(offset uint64) ([]byte, error) {
+	i, found := slices.BinarySearchFunc(r.trees, offset, func(t *KeyedHashTree, offset uint64) int {
+		switch {
+		case offset < t.base:
+			return 1
+		case offset >= t.limit:
+			return -1
+		default:
+			return 0
+		}
+	})
+	if !found {
+		return nil, &OffsetError{Offset: offset, Base: r.start, MaxSize: r.end}
+	}
+	return r.trees[i].KeyAt(offset)
+}
+
+// Key returns the derived key at the given offset. It panics if the offset is
+// outside the tree's range.
+func (r *RangeTree) Key(offset uint64) []byte {
+	k, err := r.KeyAt(offset)
+	if err != nil {
+		panic("offset outside of range")
+	}
+	return k
+}
+
+// Wipe zeroes the keys of the tree's nodes, after which it can't derive keys.
+func (r *RangeTree) Wipe() {
+	for _, t := range r.trees {
+		t.Wipe()
+	}
+}
+
+// exportCipher returns the AES-256-GCM cipher for a range export with the given
+// shared secret, ephemeral public key, and recipient public key. It wipes the
+// shared secret.
+func exportCipher(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	defer Wipe(shared)
+
+	salt := append(slices.Clone(ephemeral), recipient...)
+	key, err := hkdf.Key(sha256.New, shared, salt, exportInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+
+	return AESGCM(key)
+}
@@ -0,0 +1,98 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestExportRange(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 4096, 4, kht.WithContext([]byte("ctx")))
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := tree.ExportRange(100, 1000, identity.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(data, []byte("yay")) {
+		t.Error("Export contains the root key")
+	}
+
+	r, err := kht.ImportRange(data, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if start, end := r.Range(); start != 96 || end != 1008 {
+		t.Errorf("Range was [%d, %d), but expected [96, 1008)", start, end)
+	}
+
+	for offset := uint64(96); offset < 1008; offset += 5 {
+		if v, want := r.Key(offset), tree.Key(offset); !bytes.Equal(v, want) {
+			t.Errorf("Key at %d was %#v, but expected %#v", offset, v, want)
+		}
+	}
+
+	for _, offset := range []uint64{0, 95, 1008, 4095} {
+		var oe *kht.OffsetError
+		if _, err := r.KeyAt(offset); !errors.As(err, &oe) {
+			t.Errorf("Error for offset %d was %v, but expected an *OffsetError", offset, err)
+		}
+	}
+}
+
+func TestImportRangeInvalid(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 4096, 4)
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := tree.ExportRange(0, 100, identity.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kht.ImportRange(data, other); err == nil {
+		t.Error("Imported an export sealed to another key")
+	}
+
+	for i := range data {
+		data[i] ^= 1
+		if _, err := kht.ImportRange(data, identity); err == nil {
+			t.Errorf("Imported an export with byte %d modified", i)
+		}
+		data[i] ^= 1
+	}
+
+	if _, err := kht.ImportRange(data[:len(data)-1], identity); err == nil {
+		t.Error("Imported a truncated export")
+	}
+
+	p256, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tree.ExportRange(0, 100, p256.PublicKey()); err == nil {
+		t.Error("Exported to a P-256 key")
+	}
+
+	if _, err := tree.ExportRange(0, 8192, identity.PublicKey()); err == nil {
+		t.Error("Exported a range outside of the tree")
+	}
+}
@@ -0,0 +1,40 @@
+package kht
+
+import "errors"
+
+// Grow returns a tree with the same root key and options as t which covers at
+// least the given maximum size, and which derives the same keys as t for every
+// offset t covers. Data encrypted with t's keys doesn't need to be re-encrypted.
+//
+// Adding levels above the root would change every key, so instead Grow widens
+// the top level of the tree: the grown tree has the same depth as t, and its
+// root has as many children as are needed to cover the new maximum size. The
+// depth of a grown tree is included in its encoding (see MarshalBinary), so it
+// survives being marshaled.
+//
+// Grow returns an error if t is a subtree, if the maximum size is less than
+// t's, or if t has a depth of zero, since a tree whose root is its only leaf
+// can't be widened.
+func (t *KeyedHashTree) Grow(maxSize uint64) (*KeyedHashTree, error) {
+	if t.top != 0 {
+		return nil, errors.New("kht: can't grow a subtree")
+	}
+
+	if maxSize < t.maxSize {
+		return nil, errors.New("kht: can't shrink a tree")
+	}
+
+	if t.depth == 0 {
+		return nil, errors.New("kht: can't grow a tree with a depth of zero")
+	}
+
+	g := new(KeyedHashTree)
+	g.copyFrom(t)
+	g.maxSize = maxSize
+	g.fixedDepth = true
+	g.limit = coveredSize(g.blockSize, g.maxSize, g.factor, g.sizes)
+	if err := g.precompute(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
@@ -0,0 +1,87 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestGrow(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 128, 4)
+
+	grown, err := tree.Grow(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := grown.Depth(), tree.Depth(); v != want {
+		t.Errorf("Depth was %d, but expected %d", v, want)
+	}
+
+	if v, want := grown.CoveredSize(), uint64(1024); v != want {
+		t.Errorf("Covered size was %d, but expected %d", v, want)
+	}
+
+	for offset := uint64(0); offset < tree.CoveredSize(); offset++ {
+		if v, want := grown.Key(offset), tree.Key(offset); !bytes.Equal(v, want) {
+			t.Errorf("Key for %d was %#v, but expected %#v", offset, v, want)
+		}
+	}
+
+	sub, err := grown.Subtree(1, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := sub.Key(20*32), grown.Key(20*32); !bytes.Equal(v, want) {
+		t.Errorf("Subtree key was %#v, but expected %#v", v, want)
+	}
+
+	data, err := grown.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded kht.KeyedHashTree
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := decoded.SetKey([]byte("yay")); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := decoded.CoveredSize(), grown.CoveredSize(); v != want {
+		t.Errorf("Decoded covered size was %d, but expected %d", v, want)
+	}
+
+	for _, offset := range []uint64{0, 127, 128, 1023} {
+		if v, want := decoded.Key(offset), grown.Key(offset); !bytes.Equal(v, want) {
+			t.Errorf("Decoded key for %d was %#v, but expected %#v", offset, v, want)
+		}
+	}
+}
+
+func TestGrowInvalid(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 128, 4)
+
+	if _, err := tree.Grow(64); err == nil {
+		t.Error("Shrank a tree")
+	}
+
+	sub, err := tree.Subtree(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sub.Grow(1024); err == nil {
+		t.Error("Grew a subtree")
+	}
+
+	single := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 2, 4)
+	if _, err := single.Grow(1024); err == nil {
+		t.Error("Grew a tree with a depth of zero")
+	}
+}
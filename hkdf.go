@@ -0,0 +1,51 @@
+package kht
+
+import "hash"
+
+// HKDF returns a keyed hash implementation using HKDF-Expand (RFC 5869) of the
+// given hash algorithm as the KDF for each node. The key is used as HKDF's
+// pseudorandom key, the bytes written to the hash are used as its info
+// parameter, and Sum returns a single hash-length block of output keying
+// material: HMAC(key, info || 0x01).
+//
+// The returned hash.Hash buffers everything written to it until Sum is
+// called, so it's intended for the short, fixed-size messages the tree hashes
+// rather than for arbitrary data.
+func HKDF(alg func() hash.Hash) KeyedHash {
+	return func(key []byte) hash.Hash {
+		return &hkdfHash{
+			mac: HMAC(alg)(key).(*hmacHash),
+		}
+	}
+}
+
+// hkdfHash adapts HKDF-Expand to hash.Hash, treating written bytes as HKDF's
+// info parameter.
+type hkdfHash struct {
+	mac  *hmacHash
+	info []byte
+}
+
+func (h *hkdfHash) Write(p []byte) (int, error) {
+	h.info = append(h.info, p...)
+	return len(p), nil
+}
+
+func (h *hkdfHash) Sum(b []byte) []byte {
+	h.mac.Reset()
+	_, _ = h.mac.Write(h.info)
+	_, _ = h.mac.Write([]byte{1})
+	return h.mac.Sum(b)
+}
+
+func (h *hkdfHash) Reset() {
+	h.info = h.info[:0]
+}
+
+func (h *hkdfHash) Size() int {
+	return h.mac.Size()
+}
+
+func (h *hkdfHash) BlockSize() int {
+	return h.mac.BlockSize()
+}
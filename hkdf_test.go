@@ -0,0 +1,47 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestHKDF(t *testing.T) {
+	key := bytes.Repeat([]byte{0x0b}, 32)
+	h := kht.HKDF(sha256.New)(key)
+	_, _ = h.Write([]byte("kht "))
+	_, _ = h.Write([]byte("info"))
+
+	want, err := hkdf.Expand(sha256.New, key, "kht info", sha256.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := h.Sum(nil); !bytes.Equal(v, want) {
+		t.Errorf("Output was %x, but expected %x", v, want)
+	}
+
+	if v := h.Sum(nil); !bytes.Equal(v, want) {
+		t.Errorf("Second output was %x, but expected %x", v, want)
+	}
+}
+
+func TestHKDFTree(t *testing.T) {
+	vectors := map[uint64]string{
+		0:    "7957cc925e9768138d8a8eb608aef9e2f5d1e1b2dd63aa054c5c52fecdbd2d13",
+		1023: "457502bfaf8307678ab35d32fda63447274e8e9855f8126f8f52385bde04d3b8",
+		1024: "4a4e03b57e5884428b3412bc1a08b05584457a89529a6b12c6d8061ec8a451c9",
+		4095: "6957a375a76103e14b37b6136f328e7da3e2504edeeb8bd690c9da285caed05c",
+	}
+
+	tree := mustNew(t, []byte("yay"), kht.HKDF(sha256.New), 256, 4096, 4)
+	for offset, want := range vectors {
+		if v := hex.EncodeToString(tree.Key(offset)); v != want {
+			t.Errorf("Key %d was %s, but expected %s", offset, v, want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package kht
+
+import "hash"
+
+// hmacHash is an implementation of HMAC (RFC 2104) which, unlike crypto/hmac,
+// can be rekeyed in place. This allows a single hash to be used for every node
+// along a path through the tree without allocating.
+type hmacHash struct {
+	inner, outer hash.Hash
+	ipad, opad   []byte
+	sum          []byte
+}
+
+func newHMAC(alg func() hash.Hash) *hmacHash {
+	h := &hmacHash{
+		inner: alg(),
+		outer: alg(),
+	}
+	h.ipad = make([]byte, h.inner.BlockSize())
+	h.opad = make([]byte, h.inner.BlockSize())
+	h.sum = make([]byte, 0, h.inner.Size())
+	return h
+}
+
+// rekey resets the hash to its initial state with the given key.
+func (h *hmacHash) rekey(key []byte) {
+	if len(key) > len(h.ipad) {
+		h.outer.Reset()
+		_, _ = h.outer.Write(key)
+		key = h.outer.Sum(h.sum[:0])
+	}
+
+	n := copy(h.ipad, key)
+	clear(h.ipad[n:])
+	copy(h.opad, h.ipad)
+	for i := range h.ipad {
+		h.ipad[i] ^= 0x36
+		h.opad[i] ^= 0x5c
+	}
+	h.Reset()
+}
+
+// wipe zeroes the hash's copies of its key and resets its underlying hashes.
+// The underlying hashes' internal buffers may still hold key-derived bytes.
+func (h *hmacHash) wipe() {
+	Wipe(h.ipad)
+	Wipe(h.opad)
+	Wipe(h.sum[:cap(h.sum)])
+	h.inner.Reset()
+	h.outer.Reset()
+}
+
+func (h *hmacHash) Write(p []byte) (int, error) {
+	return h.inner.Write(p)
+}
+
+func (h *hmacHash) Sum(b []byte) []byte {
+	in := h.inner.Sum(h.sum[:0])
+	h.outer.Reset()
+	_, _ = h.outer.Write(h.opad)
+	_, _ = h.outer.Write(in)
+	return h.outer.Sum(b)
+}
+
+func (h *hmacHash) Reset() {
+	h.inner.Reset()
+	_, _ = h.inner.Write(h.ipad)
+}
+
+func (h *hmacHash) Size() int {
+	return h.outer.Size()
+}
+
+func (h *hmacHash) BlockSize() int {
+	return h.inner.BlockSize()
+}
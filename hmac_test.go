@@ -0,0 +1,44 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestHMAC(t *testing.T) {
+	algs := map[string]func() hash.Hash{
+		"MD5":     md5.New,
+		"SHA-256": sha256.New,
+		"SHA-512": sha512.New,
+	}
+
+	for name, alg := range algs {
+		for _, n := range []int{0, 16, 64, 128, 200} {
+			key := bytes.Repeat([]byte{0xAA}, n)
+			h, want := kht.HMAC(alg)(key), hmac.New(alg, key)
+
+			for _, msg := range []string{"", "yay", "yay yay yay"} {
+				_, _ = h.Write([]byte(msg))
+				_, _ = want.Write([]byte(msg))
+				if v, w := h.Sum(nil), want.Sum(nil); !bytes.Equal(v, w) {
+					t.Errorf("HMAC-%s with a %d-byte key was %x, but expected %x", name, n, v, w)
+				}
+			}
+
+			h.Reset()
+			want.Reset()
+			_, _ = h.Write([]byte("reset"))
+			_, _ = want.Write([]byte("reset"))
+			if v, w := h.Sum(nil), want.Sum(nil); !bytes.Equal(v, w) {
+				t.Errorf("Reset HMAC-%s with a %d-byte key was %x, but expected %x", name, n, v, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package kht
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrIntegrity is returned when a block's ciphertext doesn't match its MAC.
+var ErrIntegrity = errors.New("kht: block failed integrity check")
+
+var (
+	macInfo       = []byte("kht mac")
+	integrityInfo = []byte("kht integrity")
+)
+
+// BlockMAC returns the MAC of the given ciphertext as the block containing the
+// given offset. The MAC is H(mac, le64(start) || ciphertext), where start is
+// the block's first offset and mac is HKDF-Expand(PRK=leaf, info="kht mac"),
+// leaf being the key of the block's leaf node, so the MAC key is independent
+// of the block's derived key and nonce (see KeyNonce). BlockMAC returns an
+// *OffsetError if the offset is out of range, and ErrNoKey if the tree has no
+// root key.
+func (t *KeyedHashTree) BlockMAC(offset uint64, ciphertext []byte) ([]byte, error) {
+	if t.root == nil {
+		return nil, ErrNoKey
+	}
+
+	if err := t.checkOffset(offset); err != nil {
+		return nil, err
+	}
+
+	leaf := t.leaf(offset)
+	defer Wipe(leaf)
+
+	k := expand(t.alg, leaf, macInfo, t.hashSize)
+	defer Wipe(k)
+
+	var start [8]byte
+	binary.LittleEndian.PutUint64(start[:], offset-offset%t.blockSize)
+
+	h := t.alg(k)
+	defer wipeHash(h)
+
+	_, _ = h.Write(start[:])
+	_, _ = h.Write(ciphertext)
+	return h.Sum(nil), nil
+}
+
+// An IntegrityTree detects tampering with the blocks of an encrypted object,
+// as a companion to the tree which derives their keys. It holds the MAC of
+// each block (see BlockMAC) and folds them, factor at a time, into a
+// Merkle-style root digest which commits to every block and to their number,
+// so a root digest kept somewhere trustworthy detects the modification,
+// reordering, truncation, or rollback of blocks kept elsewhere.
+//
+// Blocks are numbered from the start of the tree, and are added in order with
+// Update. Changing a block only recomputes the digests above it. An
+// IntegrityTree isn't safe for concurrent use.
+type IntegrityTree struct {
+	tree   *KeyedHashTree
+	key    []byte     // the key of the folded digests
+	levels [][][]byte // levels[0] holds the block MACs, the last the top digest
+}
+
+// NewIntegrityTree returns an empty integrity tree for the blocks of the given
+// tree, which must not be wiped or given a new root key while the integrity
+// tree is in use. The digests are keyed with HKDF-Expand(PRK=root,
+// info="kht integrity"), so only holders of the tree's root key can compute or
+// check a root digest. It returns ErrNoKey if the tree has no root key, and an
+// error if the tree is a subtree.
+func NewIntegrityTree(tree *KeyedHashTree) (*IntegrityTree, error) {
+	if tree.root == nil {
+		return nil, ErrNoKey
+	}
+
+	if tree.top != 0 {
+		return nil, errors.New("kht: can't build an integrity tree for a subtree")
+	}
+
+	return &IntegrityTree{
+		tree:   tree,
+		key:    expand(tree.alg, tree.root, integrityInfo, tree.hashSize),
+		levels: [][][]byte{nil},
+	}, nil
+}
+
+// Len returns the number of blocks in the integrity tree.
+func (it *IntegrityTree) Len() uint64 {
+	return uint64(len(it.levels[0]))
+}
+
+// Update sets the ciphertext of the block containing the given offset,
+// updating the root digest. The block must either be in the integrity tree
+// already or immediately follow its last block. Update returns an
+// *OffsetError if the offset is out of the tree's range, and an error if the
+// block would leave a gap.
+func (it *IntegrityTree) Update(offset uint64, ciphertext []byte) error {
+	mac, err := it.tree.BlockMAC(offset, ciphertext)
+	if err != nil {
+		return err
+	}
+
+	i := offset / it.tree.blockSize
+	if i > it.Len() {
+		return errors.New("kht: update would leave a gap")
+	}
+
+	f := it.tree.factor
+	it.set(0, i, mac)
+	for level := 0; level+1 < len(it.levels) || len(it.levels[level]) > 1; level++ {
+		if level+1 == len(it.levels) {
+			it.levels = append(it.levels, nil)
+		}
+
+		children := it.levels[level]
+		i /= f
+		it.set(level+1, i, it.fold(uint64(level+1), i, children[i*f:min(i*f+f, uint64(len(children)))]))
+	}
+	return nil
+}
+
+// Verify returns ErrIntegrity unless the given ciphertext is the ciphertext
+// of the block containing the given offset, as last set by Update. It returns
+// an *OffsetError if the offset is out of the tree's range.
+func (it *IntegrityTree) Verify(offset uint64, ciphertext []byte) error {
+	mac, err := it.tree.BlockMAC(offset, ciphertext)
+	if err != nil {
+		return err
+	}
+
+	i := offset / it.tree.blockSize
+	if i >= it.Len() || !hmac.Equal(mac, it.levels[0][i]) {
+		return ErrIntegrity
+	}
+	return nil
+}
+
+// Root returns the root digest, H(key, le64(n) || top), where n is the number
+// of blocks and top is the digest which folds all of their MACs. The digest of
+// the node at a given level and index of the integrity tree is H(key,
+// le64(level) || le64(index) || c0 || c1...), where c0, c1... are the digests
+// (or, for the bottom level, the MACs) of its children, so each digest commits
+// to its position. With no blocks, top is empty.
+func (it *IntegrityTree) Root() []byte {
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], it.Len())
+
+	h := it.tree.alg(it.key)
+	defer wipeHash(h)
+
+	_, _ = h.Write(n[:])
+	if it.Len() > 0 {
+		top := it.levels[len(it.levels)-1]
+		_, _ = h.Write(top[0])
+	}
+	return h.Sum(nil)
+}
+
+// VerifyRoot returns ErrIntegrity unless the given root digest is the
+// integrity tree's root digest, in constant time.
+func (it *IntegrityTree) VerifyRoot(root []byte) error {
+	if !hmac.Equal(root, it.Root()) {
+		return ErrIntegrity
+	}
+	return nil
+}
+
+// Wipe zeroes the integrity tree's digest key. The integrity tree can't be
+// used afterwards.
+func (it *IntegrityTree) Wipe() {
+	Wipe(it.key)
+	it.key = nil
+	it.levels = nil
+}
+
+// set sets or appends the digest at the given level and index.
+func (it *IntegrityTree) set(level int, i uint64, d []byte) {
+	if i == uint64(len(it.levels[level])) {
+		it.levels[level] = append(it.levels[level], d)
+	} else {
+		it.levels[level][i] = d
+	}
+}
+
+// fold returns the digest of the node at the given level and index, given the
+// digests of its children.
+func (it *IntegrityTree) fold(level, index uint64, children [][]byte) []byte {
+	var pos [16]byte
+	binary.LittleEndian.PutUint64(pos[:8], level)
+	binary.LittleEndian.PutUint64(pos[8:], index)
+
+	h := it.tree.alg(it.key)
+	defer wipeHash(h)
+
+	_, _ = h.Write(pos[:])
+	for _, c := range children {
+		_, _ = h.Write(c)
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,117 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestIntegrityTree(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+
+	block := func(i int, s string) []byte {
+		return []byte(fmt.Sprintf("%s block %02d", s, i))
+	}
+
+	build := func(n int, changed int) *kht.IntegrityTree {
+		it, err := kht.NewIntegrityTree(tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range n {
+			b := block(i, "old")
+			if i == changed {
+				b = block(i, "new")
+			}
+
+			if err := it.Update(uint64(i)*16, b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return it
+	}
+
+	it := build(40, -1)
+	if v, want := it.Len(), uint64(40); v != want {
+		t.Errorf("Length was %d, but expected %d", v, want)
+	}
+
+	for i := range 40 {
+		if err := it.Verify(uint64(i)*16+3, block(i, "old")); err != nil {
+			t.Errorf("Block %d failed verification: %v", i, err)
+		}
+	}
+
+	if err := it.Verify(7*16, block(7, "new")); err != kht.ErrIntegrity {
+		t.Errorf("Error for a modified block was %v, but expected ErrIntegrity", err)
+	}
+
+	if err := it.Verify(8*16, block(7, "old")); err != kht.ErrIntegrity {
+		t.Errorf("Error for a moved block was %v, but expected ErrIntegrity", err)
+	}
+
+	if err := it.Verify(40*16, block(40, "old")); err != kht.ErrIntegrity {
+		t.Errorf("Error for a missing block was %v, but expected ErrIntegrity", err)
+	}
+
+	old := it.Root()
+	if err := it.Update(7*16, block(7, "new")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := it.VerifyRoot(old); err != kht.ErrIntegrity {
+		t.Errorf("Error for a rolled-back root was %v, but expected ErrIntegrity", err)
+	}
+
+	if v, want := it.Root(), build(40, 7).Root(); !bytes.Equal(v, want) {
+		t.Errorf("Updated root was %#v, but expected %#v", v, want)
+	}
+
+	if err := build(40, -1).VerifyRoot(old); err != nil {
+		t.Errorf("Rebuilt root failed verification: %v", err)
+	}
+
+	if v := build(39, -1).Root(); bytes.Equal(v, old) {
+		t.Error("Truncated tree had the same root")
+	}
+
+	if err := it.Update(42*16, block(42, "old")); err == nil {
+		t.Error("Updated a block past a gap")
+	}
+
+	if err := it.Update(1024, nil); err == nil {
+		t.Error("Updated a block out of range")
+	}
+}
+
+func TestIntegrityTreeEmpty(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	other := mustNew(t, []byte("boo"), kht.HMAC(sha256.New), 16, 1024, 4)
+
+	a, err := kht.NewIntegrityTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := kht.NewIntegrityTree(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(a.Root(), b.Root()) {
+		t.Error("Trees with different root keys had the same root digest")
+	}
+
+	sub, err := tree.Subtree(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kht.NewIntegrityTree(sub); err == nil {
+		t.Error("Built an integrity tree for a subtree")
+	}
+}
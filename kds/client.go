@@ -0,0 +1,171 @@
+package kds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/codahale/kht"
+)
+
+// A Client requests ranges of objects' keys from a Server and derives block
+// keys from them locally. It caches the nodes it receives, so keys for offsets
+// within a fetched range are derived without contacting the server. Each
+// object's cache holds at most 256 nodes; when it's full, the oldest nodes
+// are wiped to make room.
+type Client struct {
+	baseURL string
+	http    *http.Client
+
+	mu      sync.Mutex
+	objects map[string][]cachedNode
+}
+
+// A cachedNode is a node received from a server, and the tree rooted at it.
+type cachedNode struct {
+	level, index uint64
+	tree         *kht.KeyedHashTree
+}
+
+// maxCachedNodes is the most nodes a Client caches for each object.
+const maxCachedNodes = 256
+
+// NewClient returns a client for the server at the given URL, which makes
+// requests with the given HTTP client. If hc is nil, http.DefaultClient is
+// used.
+func NewClient(baseURL string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	return &Client{
+		baseURL: baseURL,
+		http:    hc,
+		objects: make(map[string][]cachedNode),
+	}
+}
+
+// Fetch requests the keys for the blocks containing [start, end) of the named
+// object and caches them.
+func (c *Client) Fetch(ctx context.Context, object string, start, end uint64) error {
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		return err
+	}
+
+	q := u.Query()
+	q.Set("object", object)
+	q.Set("start", strconv.FormatUint(start, 10))
+	q.Set("end", strconv.FormatUint(end, 10))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("kds: %s: %q", resp.Status, msg)
+	}
+
+	var body response
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+
+	var params kht.KeyedHashTree
+	if err := params.UnmarshalBinary(body.Params); err != nil {
+		return err
+	}
+
+	nodes := make([]cachedNode, 0, len(body.Nodes))
+	for _, n := range body.Nodes {
+		tree, err := params.NodeTree(kht.Node{Level: n.Level, Index: n.Index, Key: n.Key})
+		kht.Wipe(n.Key)
+		if err != nil {
+			wipeNodes(nodes)
+			return err
+		}
+		nodes = append(nodes, cachedNode{level: n.Level, index: n.Index, tree: tree})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached := c.objects[object]
+	for _, n := range nodes {
+		if slices.ContainsFunc(cached, func(m cachedNode) bool {
+			return m.level == n.level && m.index == n.index
+		}) {
+			n.tree.Wipe() // already cached
+			continue
+		}
+		cached = append(cached, n)
+	}
+
+	if over := len(cached) - maxCachedNodes; over > 0 {
+		wipeNodes(cached[:over])
+		cached = slices.Delete(cached, 0, over)
+	}
+	c.objects[object] = cached
+	return nil
+}
+
+// Key returns the key for the block containing the given offset of the named
+// object. If no cached range contains the offset, Key fetches the key for that
+// block alone.
+func (c *Client) Key(ctx context.Context, object string, offset uint64) ([]byte, error) {
+	if k, ok := c.cached(object, offset); ok {
+		return k, nil
+	}
+
+	if err := c.Fetch(ctx, object, offset, offset+1); err != nil {
+		return nil, err
+	}
+
+	if k, ok := c.cached(object, offset); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("kds: server didn't return a key for offset %d", offset)
+}
+
+// Forget wipes and discards the cached keys for the named object.
+func (c *Client) Forget(object string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wipeNodes(c.objects[object])
+	delete(c.objects, object)
+}
+
+func (c *Client) cached(object string, offset uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, n := range c.objects[object] {
+		if k, err := n.tree.KeyAt(offset); err == nil {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// wipeNodes wipes the keys of the given nodes.
+func wipeNodes(nodes []cachedNode) {
+	for _, n := range nodes {
+		n.tree.Wipe()
+	}
+}
@@ -0,0 +1,26 @@
+// Package kds provides a key distribution service for keyed hash trees.
+//
+// A Server holds the root keys of many objects and, over HTTP, hands out the
+// keys of the nodes which cover a requested range of an object (see
+// kht.KeyedHashTree.RangeCover), subject to an authorization check. A Client
+// requests those nodes, caches them, and derives block keys from them locally,
+// without ever seeing an object's root key. This is the arrangement described
+// in the papers on Horus.
+package kds
+
+// A response is the body of a successful request for a range of an object's
+// keys.
+type response struct {
+	// Params are the tree's parameters, as encoded by MarshalBinary.
+	Params []byte `json:"params"`
+
+	// Nodes are the nodes covering the requested range.
+	Nodes []node `json:"nodes"`
+}
+
+// A node is the encoding of a kht.Node.
+type node struct {
+	Level uint64 `json:"level"`
+	Index uint64 `json:"index"`
+	Key   []byte `json:"key"`
+}
@@ -0,0 +1,215 @@
+package kds_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/codahale/kht"
+	"github.com/codahale/kht/kds"
+)
+
+func TestClient(t *testing.T) {
+	tree, err := kht.New([]byte("yay"), kht.HMAC(sha256.New), 16, 4096, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := kds.NewServer(func(r *http.Request, object string, start, end uint64) bool {
+		return r.Header.Get("Authorization") == "alice" && end <= 1024
+	})
+	if err := server.Add("object", tree); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		server.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	client := kds.NewClient(ts.URL, &http.Client{Transport: authTransport("alice")})
+	if err := client.Fetch(ctx, "object", 100, 700); err != nil {
+		t.Fatal(err)
+	}
+
+	for offset := uint64(96); offset < 704; offset += 16 {
+		k, err := client.Key(ctx, "object", offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := tree.Key(offset); !bytes.Equal(k, want) {
+			t.Errorf("Key for %d was %#v, but expected %#v", offset, k, want)
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("Made %d requests, but expected 1", requests)
+	}
+
+	k, err := client.Key(ctx, "object", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := tree.Key(1000); !bytes.Equal(k, want) {
+		t.Errorf("Key for 1000 was %#v, but expected %#v", k, want)
+	}
+
+	if requests != 2 {
+		t.Errorf("Made %d requests, but expected 2", requests)
+	}
+
+	if _, err := client.Key(ctx, "object", 2000); err == nil {
+		t.Error("Fetched an unauthorized range")
+	}
+
+	if _, err := client.Key(ctx, "nope", 0); err == nil {
+		t.Error("Fetched keys for an unknown object")
+	}
+
+	client.Forget("object")
+	if _, err := kds.NewClient(ts.URL, nil).Key(ctx, "object", 0); err == nil {
+		t.Error("Fetched keys without authorization")
+	}
+}
+
+func TestServerAuthorizesBlocks(t *testing.T) {
+	tree, err := kht.New([]byte("yay"), kht.HMAC(sha256.New), 16, 4096, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got [2]uint64
+	server := kds.NewServer(func(_ *http.Request, _ string, start, end uint64) bool {
+		got = [2]uint64{start, end}
+		return end <= 1001
+	})
+	if err := server.Add("object", tree); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query      string
+		authorized [2]uint64
+		status     int
+	}{
+		{"start=3&end=5", [2]uint64{0, 16}, http.StatusOK},
+		{"start=20&end=32", [2]uint64{16, 32}, http.StatusOK},
+		{"start=1000&end=1001", [2]uint64{992, 1008}, http.StatusForbidden},
+		{"start=4090&end=4095", [2]uint64{4080, 4096}, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?object=object&"+test.query, nil))
+		if got != test.authorized {
+			t.Errorf("%q authorized %v, but expected %v", test.query, got, test.authorized)
+		}
+
+		if w.Code != test.status {
+			t.Errorf("%q returned %d, but expected %d", test.query, w.Code, test.status)
+		}
+	}
+}
+
+func TestClientCacheBound(t *testing.T) {
+	tree, err := kht.New([]byte("yay"), kht.HMAC(sha256.New), 16, 8192, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := kds.NewServer(func(*http.Request, string, uint64, uint64) bool { return true })
+	if err := server.Add("object", tree); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		server.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	client := kds.NewClient(ts.URL, nil)
+	for offset := uint64(0); offset < 257*16; offset += 16 {
+		if _, err := client.Key(ctx, "object", offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Fetching a cached range again adds no nodes.
+	if err := client.Fetch(ctx, "object", 16, 32); err != nil {
+		t.Fatal(err)
+	}
+
+	requests = 0
+	if _, err := client.Key(ctx, "object", 16); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 0 {
+		t.Errorf("Made %d requests for a cached key, but expected none", requests)
+	}
+
+	k, err := client.Key(ctx, "object", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 1 {
+		t.Errorf("Made %d requests for an evicted key, but expected 1", requests)
+	}
+
+	if want := tree.Key(0); !bytes.Equal(k, want) {
+		t.Errorf("Key for 0 was %#v, but expected %#v", k, want)
+	}
+}
+
+func TestServerStatus(t *testing.T) {
+	tree, err := kht.New([]byte("yay"), kht.HMAC(sha256.New), 16, 4096, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := kds.NewServer(func(*http.Request, string, uint64, uint64) bool { return true })
+	if err := server.Add("object", tree); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, query string
+		status        int
+	}{
+		{http.MethodGet, "object=object&start=0&end=16", http.StatusOK},
+		{http.MethodPost, "object=object&start=0&end=16", http.StatusMethodNotAllowed},
+		{http.MethodGet, "object=object&start=16&end=16", http.StatusBadRequest},
+		{http.MethodGet, "object=object&start=x&end=16", http.StatusBadRequest},
+		{http.MethodGet, "start=0&end=16", http.StatusBadRequest},
+		{http.MethodGet, "object=nope&start=0&end=16", http.StatusNotFound},
+		{http.MethodGet, "object=object&start=0&end=5000", http.StatusRequestedRangeNotSatisfiable},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(test.method, "/?"+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("%s %q returned %d, but expected %d", test.method, test.query, w.Code, test.status)
+		}
+	}
+}
+
+type authTransport string
+
+func (a authTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", string(a))
+	return http.DefaultTransport.RoundTrip(r)
+}
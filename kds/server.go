@@ -0,0 +1,143 @@
+package kds
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/codahale/kht"
+)
+
+// An Authorizer reports whether the given request may receive the keys for the
+// range [start, end) of the named object. It typically identifies the client
+// from the request's TLS state or credentials. The range is the one whose keys
+// would be served: the requested range, rounded out to the boundaries of the
+// object's blocks.
+type Authorizer func(r *http.Request, object string, start, end uint64) bool
+
+// A Server is an http.Handler which serves the keys for ranges of objects.
+//
+// Requests are GETs with object, start, and end query parameters. Successful
+// responses are JSON objects with the tree's parameters and the nodes which
+// cover the blocks containing [start, end). A Server responds with 403 if the
+// authorizer rejects a request, 404 if the object is unknown, and 416 if the
+// range is outside of the object's tree.
+type Server struct {
+	authorize Authorizer
+
+	mu    sync.RWMutex
+	trees map[string]*kht.KeyedHashTree
+}
+
+// NewServer returns a server with no objects which uses the given authorizer
+// for every request.
+func NewServer(authorize Authorizer) *Server {
+	return &Server{
+		authorize: authorize,
+		trees:     make(map[string]*kht.KeyedHashTree),
+	}
+}
+
+// Add registers the tree for the named object, replacing any existing tree for
+// it. The tree must have a root key, and its keyed hash must be registered (see
+// kht.RegisterKeyedHash) so that clients can reconstruct it.
+func (s *Server) Add(object string, tree *kht.KeyedHashTree) error {
+	if _, err := tree.MarshalBinary(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trees[object] = tree
+	return nil
+}
+
+// Remove unregisters the named object.
+func (s *Server) Remove(object string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.trees, object)
+}
+
+// ServeHTTP serves a request for a range of an object's keys.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	object := q.Get("object")
+	start, err1 := strconv.ParseUint(q.Get("start"), 10, 64)
+	end, err2 := strconv.ParseUint(q.Get("end"), 10, 64)
+	if object == "" || err1 != nil || err2 != nil || start >= end {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.RLock()
+	tree, ok := s.trees[object]
+	s.mu.RUnlock()
+
+	if ok {
+		start, end = blockRange(tree, start, end)
+	}
+
+	if !s.authorize(r, object, start, end) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !ok {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+
+	params, err := tree.MarshalBinary()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nodes, err := tree.RangeCover(start, end)
+	if errors.Is(err, kht.ErrOffsetOutOfRange) {
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := response{Params: params, Nodes: make([]node, len(nodes))}
+	for i, n := range nodes {
+		resp.Nodes[i] = node{Level: n.Level, Index: n.Index, Key: n.Key}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(&resp)
+
+	for _, n := range nodes {
+		kht.Wipe(n.Key)
+	}
+}
+
+// blockRange returns [start, end) rounded out to the boundaries of the tree's
+// blocks, which is the range of keys RangeCover returns for it.
+func blockRange(tree *kht.KeyedHashTree, start, end uint64) (uint64, uint64) {
+	bs, covered := tree.BlockSize(), tree.CoveredSize()
+	start -= start % bs
+	if r := end % bs; r != 0 && end <= covered {
+		if covered-end < bs-r {
+			end = covered
+		} else {
+			end += bs - r
+		}
+	}
+	return start, end
+}
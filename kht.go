@@ -30,70 +30,1011 @@
 package kht
 
 import (
-	"crypto/hmac"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"hash"
 	"math"
+	"sync"
+	"time"
 )
 
 // A KeyedHash is a hash algorithm which depends on a secret key.
 type KeyedHash func(key []byte) hash.Hash
 
 // HMAC returns a keyed hash implementation using the HMAC of the given hash
-// algorithm.
+// algorithm. The tree reuses HMAC hashes across nodes, so derivation with an
+// HMAC keyed hash doesn't allocate a new hash for every level.
 func HMAC(alg func() hash.Hash) KeyedHash {
 	return func(key []byte) hash.Hash {
-		return hmac.New(alg, key)
+		h := newHMAC(alg)
+		h.rekey(key)
+		return h
 	}
 }
 
 // A KeyedHashTree is a tree of keyed hashes, used to derive keys.
+//
+// A KeyedHashTree is safe for concurrent use by multiple goroutines. Scratch
+// space for derivation is kept in a sync.Pool, so concurrent calls to Key and
+// KeyInto never share buffers or hash state. The node cache is guarded by a
+// mutex, precomputed keys are only read once the root key is set, and every
+// cursor (see Keys) belongs to a single call. Only SetKey, Wipe, and
+// UnmarshalBinary modify the tree, and they must not be called concurrently
+// with anything else. Goroutines which would rather not share a node cache can
+// each use a Clone.
 type KeyedHashTree struct {
-	root                      []byte
+	root, context             []byte
 	alg                       KeyedHash
 	blockSize, maxSize, depth uint64
-	factor                    float64
+	fixedDepth                bool     // the depth isn't computed from maxSize
+	top, base                 uint64   // the level and first offset of the root
+	limit                     uint64   // the end of the range of valid offsets
+	sizes                     []uint64 // the size of each node, by level
+	factor                    uint64
+	stretch, nameLen, outLen  int
+	hashSize                  int
+	policy                    TruncatePolicy
+	scratch                   sync.Pool
+	cacheSize                 int
+	cache                     *nodeCache    // nil unless the cache is enabled
+	batch                     BatchHash     // nil unless batch derivation is enabled
+	observer                  Observer      // nil unless derivations are observed
+	argon2                    *Argon2Params // nil unless the root key is a passphrase
+	salt                      []byte
+	preLevels                 int
+	pre                       *precomputed // nil unless keys are precomputed
+}
+
+// A TruncatePolicy determines how a derived key is fit to a requested length.
+type TruncatePolicy int
+
+const (
+	// HKDFExpand runs the leaf key through HKDF-Expand, using the leaf key as
+	// the pseudorandom key, "kht output" as the info parameter, and the tree's
+	// keyed hash as the PRF. It produces keys of any length up to 255 times the
+	// hash size, and the output is domain-separated from every node key in the
+	// tree. This is the default, and the recommended, policy.
+	HKDFExpand TruncatePolicy = iota
+
+	// Leading uses the first n bytes of the leaf key.
+	Leading
+
+	// Trailing uses the last n bytes of the leaf key.
+	Trailing
+)
+
+// An Option configures optional behavior of a KeyedHashTree.
+type Option func(*KeyedHashTree)
+
+// WithRootStretch returns an Option which hardens the root key before any keys
+// are derived from it, for trees built from short or low-entropy roots.
+//
+// The root key is replaced with PBKDF2(root, "kht root stretch", iterations),
+// using the tree's keyed hash as the PRF and producing a single output block
+// the length of the hash. This happens once, when the root key is set. A
+// stretched tree derives entirely different keys than an unstretched tree with
+// the same root, so every party deriving keys from a root must agree on the
+// iteration count. Creating the tree returns an error if the count is greater
+// than MaxRootStretch.
+func WithRootStretch(iterations int) Option {
+	return func(t *KeyedHashTree) {
+		t.stretch = iterations
+	}
+}
+
+// MaxRootStretch is the largest iteration count WithRootStretch accepts, which
+// bounds the work done to rebuild a tree from untrusted parameters.
+const MaxRootStretch = 10_000_000
+
+// WithNameLength returns an Option which sets the number of bytes of keyed
+// hash output used by BlockName. The default is 16 bytes, and lengths greater
+// than the output size of the tree's keyed hash are capped at that size.
+func WithNameLength(n int) Option {
+	return func(t *KeyedHashTree) {
+		t.nameLen = n
+	}
+}
+
+// WithOutputLength returns an Option which makes Key return keys of exactly n
+// bytes, fit from the leaf key using the given policy. Leading and Trailing
+// can only shorten keys, so n must not be greater than the output size of the
+// tree's keyed hash.
+func WithOutputLength(n int, policy TruncatePolicy) Option {
+	return func(t *KeyedHashTree) {
+		t.outLen = n
+		t.policy = policy
+	}
+}
+
+// WithKeyLength returns an Option which makes Key return keys of exactly n
+// bytes, expanded from the leaf key with HKDF-Expand, so that keys can be sized
+// for the cipher which uses them (e.g., 64 bytes for AES-256-XTS, or 28 bytes
+// for an AES-128 key and a 12-byte IV) regardless of the keyed hash's output
+// size. It's shorthand for WithOutputLength(n, HKDFExpand).
+func WithKeyLength(n int) Option {
+	return WithOutputLength(n, HKDFExpand)
+}
+
+// WithContext returns an Option which binds the tree to the given context
+// label, so that trees with the same root key but different labels derive
+// independent keys, while trees with the same root key and label derive the
+// same keys.
+//
+// The root key is replaced with H(root, "kht context" || len(label) || label),
+// where len(label) is a little-endian uint64, after any stretching. Trees with
+// an empty label derive the same keys as trees with no label.
+//
+// Labels separate the trees for different purposes (e.g., data and metadata,
+// or two files) which share a root key. Every node is derived from the
+// labeled root, so the label is mixed into every node derivation without
+// changing the node encoding: distinct labels yield unrelated keys at every
+// level of the tree, and a node key delegated from one tree (see NodeKey)
+// reveals nothing about the other.
+func WithContext(label []byte) Option {
+	label = bytes.Clone(label)
+	return func(t *KeyedHashTree) {
+		t.context = label
+	}
 }
 
 // New returns a KeyedHashTree with the given root key, keyed hash algorithm,
-// block size, maximum size, and branching factor.
-func New(key []byte, alg KeyedHash, blockSize, maxSize uint64, factor float64) *KeyedHashTree {
-	return &KeyedHashTree{
-		root:      key,
+// block size, maximum size, and branching factor. It returns an error if the
+// key is empty, the keyed hash is nil, the block size is zero, the maximum size
+// is less than the block size, the branching factor is not an integer greater
+// than 1, or an option's value is out of range.
+//
+// The factor is a float64 for compatibility, but only integral factors are
+// allowed: the nodes of a tree with a fractional factor don't nest evenly,
+// and its geometry can't be computed exactly. The tree's geometry is computed
+// entirely with integer arithmetic, as with NewInt.
+//
+// The tree's depth is the smallest number of levels whose leaves cover the
+// maximum size, so the leaves may cover more than that. The maximum size is
+// effectively rounded up to the tree's CoveredSize: keys can be derived for
+// every offset less than CoveredSize, and for no others. To choose the depth
+// instead, use NewWithDepth.
+func New(key []byte, alg KeyedHash, blockSize, maxSize uint64, factor float64, opts ...Option) (*KeyedHashTree, error) {
+	if len(key) == 0 {
+		return nil, errors.New("kht: key must not be empty")
+	}
+
+	f, err := integralFactor(factor)
+	if err != nil {
+		return nil, err
+	}
+	return NewInt(key, alg, blockSize, maxSize, f, opts...)
+}
+
+// integralFactor returns the given branching factor as an integer, or an error
+// if it isn't an integer greater than 1.
+func integralFactor(factor float64) (uint64, error) {
+	if !(factor > 1) || math.IsInf(factor, 0) {
+		return 0, errors.New("kht: factor must be greater than 1")
+	}
+
+	if factor != math.Trunc(factor) || factor >= 1<<64 {
+		return 0, errors.New("kht: factor must be an integer")
+	}
+	return uint64(factor), nil
+}
+
+// NewInt returns a KeyedHashTree like New, but with the branching factor as an
+// integer. It derives the same keys as a tree returned by New with the same
+// factor.
+func NewInt(key []byte, alg KeyedHash, blockSize, maxSize, factor uint64, opts ...Option) (*KeyedHashTree, error) {
+	if len(key) == 0 {
+		return nil, errors.New("kht: key must not be empty")
+	}
+
+	if factor < 2 {
+		return nil, errors.New("kht: factor must be greater than 1")
+	}
+
+	t := &KeyedHashTree{
 		alg:       alg,
 		blockSize: blockSize,
 		maxSize:   maxSize,
 		factor:    factor,
+		nameLen:   16,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	if err := t.init(); err != nil {
+		return nil, err
+	}
+
+	if err := t.SetKey(key); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// NewWithDepth returns a KeyedHashTree like NewInt, but with a fixed depth
+// instead of a maximum size. The tree's leaves cover blockSize·factor^depth
+// bytes (or every offset, if that overflows a uint64), which is its maximum
+// size, so an object which grows without a known bound, such as an
+// append-only log, can keep using one tree up to the depth's capacity.
+// It returns an error if the nodes below the root would cover more than a
+// uint64 can count, as well as for any of the reasons NewInt does.
+func NewWithDepth(key []byte, alg KeyedHash, blockSize, factor, depth uint64, opts ...Option) (*KeyedHashTree, error) {
+	if len(key) == 0 {
+		return nil, errors.New("kht: key must not be empty")
+	}
+
+	if factor < 2 {
+		return nil, errors.New("kht: factor must be greater than 1")
+	}
+
+	maxSize := uint64(math.MaxUint64) // the capacity overflows, so every offset is covered
+	if n, ok := capacity(blockSize, factor, depth); ok {
+		maxSize = n
+	}
+
+	t := &KeyedHashTree{
+		alg:        alg,
+		blockSize:  blockSize,
+		maxSize:    maxSize,
+		factor:     factor,
+		depth:      depth,
+		fixedDepth: true,
+		nameLen:    16,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	if err := t.init(); err != nil {
+		return nil, err
+	}
+
+	if err := t.SetKey(key); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// capacity returns blockSize·factor^depth, and whether it fits in a uint64.
+func capacity(blockSize, factor, depth uint64) (uint64, bool) {
+	n := blockSize
+	for range depth {
+		if n > math.MaxUint64/factor {
+			return 0, false
+		}
+		n *= factor
+	}
+	return n, true
+}
 
-		depth: uint64(
-			math.Ceil(
-				math.Log(float64(maxSize)/float64(blockSize)) /
-					math.Log(factor),
-			),
-		),
+// The defaults used by NewTree.
+const (
+	DefaultBlockSize = 4 << 10 // 4 KiB
+	DefaultMaxSize   = 4 << 40 // 4 TiB, which is exactly three levels of 1024 4 KiB blocks
+	DefaultFactor    = 1024
+)
+
+// NewTree returns a KeyedHashTree with the given root key, configured entirely
+// with options. Unless they're set with WithHash, WithBlockSize, WithMaxSize,
+// and WithBranchingFactor, the tree uses HMAC-SHA256, 4 KiB blocks, a maximum
+// size of 4 TiB, and a branching factor of 1024. It returns an error in the
+// same cases as New.
+func NewTree(key []byte, opts ...Option) (*KeyedHashTree, error) {
+	if len(key) == 0 {
+		return nil, errors.New("kht: key must not be empty")
+	}
+
+	t := &KeyedHashTree{
+		alg:       HMAC(sha256.New),
+		blockSize: DefaultBlockSize,
+		maxSize:   DefaultMaxSize,
+		factor:    DefaultFactor,
+		nameLen:   16,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	if err := t.init(); err != nil {
+		return nil, err
+	}
+
+	if err := t.SetKey(key); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// WithHash returns an Option which sets the tree's keyed hash. It's intended
+// for NewTree; with the other constructors, it overrides their alg argument.
+func WithHash(alg KeyedHash) Option {
+	return func(t *KeyedHashTree) {
+		t.alg = alg
 	}
 }
 
-// Key returns the derived key at the given offset.
+// WithBlockSize returns an Option which sets the tree's block size. It's
+// intended for NewTree; with the other constructors, it overrides their
+// blockSize argument.
+func WithBlockSize(n uint64) Option {
+	return func(t *KeyedHashTree) {
+		t.blockSize = n
+	}
+}
+
+// WithMaxSize returns an Option which sets the tree's maximum size. It's
+// intended for NewTree; with the other constructors, it overrides their
+// maxSize argument.
+func WithMaxSize(n uint64) Option {
+	return func(t *KeyedHashTree) {
+		t.maxSize = n
+	}
+}
+
+// WithBranchingFactor returns an Option which sets the tree's branching
+// factor, which must be greater than 1. It's intended for NewTree; with the
+// other constructors, it overrides their factor argument.
+func WithBranchingFactor(n uint64) Option {
+	return func(t *KeyedHashTree) {
+		t.factor = n
+	}
+}
+
+// init validates the tree's parameters and computes its geometry.
+func (t *KeyedHashTree) init() error {
+	if t.alg == nil {
+		return errors.New("kht: alg must not be nil")
+	}
+
+	if t.blockSize == 0 {
+		return errors.New("kht: blockSize must be greater than zero")
+	}
+
+	if t.maxSize < t.blockSize {
+		return errors.New("kht: maxSize must not be less than blockSize")
+	}
+
+	if t.factor < 2 {
+		return errors.New("kht: factor must be greater than 1")
+	}
+
+	if t.nameLen <= 0 {
+		return errors.New("kht: name length must be greater than zero")
+	}
+
+	if t.policy < HKDFExpand || t.policy > Trailing {
+		return fmt.Errorf("kht: unknown truncate policy %d", t.policy)
+	}
+
+	if t.cacheSize < 0 {
+		return errors.New("kht: node cache size must not be negative")
+	}
+
+	if t.stretch > MaxRootStretch {
+		return errors.New("kht: root stretch iterations must not be greater than MaxRootStretch")
+	}
+
+	if err := t.checkArgon2(); err != nil {
+		return err
+	}
+
+	if err := t.checkBatch(); err != nil {
+		return err
+	}
+
+	t.hashSize = t.alg(probeKey).Size()
+	if t.outLen > 0 {
+		size := t.hashSize
+		if t.policy == HKDFExpand && t.outLen > 255*size {
+			return errors.New("kht: output length must not be greater than 255 times the hash size")
+		} else if t.policy != HKDFExpand && t.outLen > size {
+			return errors.New("kht: output length must not be greater than the hash size")
+		}
+	}
+
+	// With a factor of at least 2, no tree is deeper than 64 levels.
+	depth := intDepth(t.blockSize, t.maxSize, t.factor)
+	if t.fixedDepth && t.depth == depth {
+		t.fixedDepth = false // the depth is the same as if it were computed
+	}
+
+	if !t.fixedDepth {
+		t.depth = depth
+	} else if err := checkDepth(t.blockSize, t.maxSize, t.factor, t.depth); err != nil {
+		return err
+	}
+	t.sizes = nodeSizes(t.blockSize, t.factor, t.depth)
+	t.limit = coveredSize(t.blockSize, t.maxSize, t.factor, t.sizes)
+	if err := t.checkPrecompute(); err != nil {
+		return err
+	}
+	t.cache = newNodeCache(t.cacheSize)
+	return nil
+}
+
+// checkDepth returns an error if a tree with the given geometry can't have the
+// given depth, either because a tree with no levels below the root can't cover
+// the maximum size or because its nodes would be too large.
+func checkDepth(blockSize, maxSize, factor, depth uint64) error {
+	if depth == 0 && maxSize > blockSize {
+		return errors.New("kht: depth is too small for maxSize")
+	}
+
+	for n, i := blockSize, uint64(1); i < depth; i++ {
+		if n > math.MaxUint64/factor {
+			return errors.New("kht: depth is too large for blockSize and factor")
+		}
+		n *= factor
+	}
+	return nil
+}
+
+// coveredSize returns the number of bytes covered by the leaves of a tree,
+// saturating at the largest uint64. The root has factor children, unless more
+// are needed to cover the maximum size (see Grow).
+func coveredSize(blockSize, maxSize, factor uint64, sizes []uint64) uint64 {
+	depth := uint64(len(sizes) - 1)
+	if depth == 0 {
+		return blockSize
+	}
+
+	n := maxSize / sizes[1]
+	if maxSize%sizes[1] != 0 {
+		n++
+	}
+	n = max(n, factor)
+
+	if sizes[1] > math.MaxUint64/n {
+		return math.MaxUint64
+	}
+	return sizes[1] * n
+}
+
+// intDepth returns the smallest depth at which a tree with the given block
+// size and branching factor covers the given maximum size.
+func intDepth(blockSize, maxSize, factor uint64) uint64 {
+	depth := uint64(0)
+	for n := blockSize; n < maxSize; n *= factor {
+		depth++
+		if n > math.MaxUint64/factor {
+			break // the next level covers more than any maximum size
+		}
+	}
+	return depth
+}
+
+// copyFrom copies the parameters, options, and key of u into t.
+func (t *KeyedHashTree) copyFrom(u *KeyedHashTree) {
+	Wipe(t.root)
+	t.root = nil
+	if u.root != nil {
+		t.root = append([]byte(nil), u.root...) // the tree wipes its own copy
+	}
+	t.context = u.context
+	t.alg = u.alg
+	t.blockSize = u.blockSize
+	t.maxSize = u.maxSize
+	t.depth = u.depth
+	t.fixedDepth = u.fixedDepth
+	t.top = u.top
+	t.base = u.base
+	t.limit = u.limit
+	t.sizes = u.sizes
+	t.factor = u.factor
+	t.stretch = u.stretch
+	t.nameLen = u.nameLen
+	t.outLen = u.outLen
+	t.hashSize = u.hashSize
+	t.policy = u.policy
+	t.scratch = sync.Pool{} // pooled scratch space may belong to a different hash
+	t.batch = u.batch
+	t.observer = u.observer
+	t.argon2 = u.argon2
+	t.salt = u.salt
+	t.preLevels = u.preLevels
+	if t.pre != nil {
+		t.pre.wipe()
+	}
+	t.pre = nil // precomputed keys belong to the root they were derived from
+	t.cacheSize = u.cacheSize
+	if t.cache != nil {
+		t.cache.wipe()
+	}
+	t.cache = newNodeCache(u.cacheSize) // cached keys may belong to a different root
+}
+
+// Clone returns an independent copy of the tree, with the same root key,
+// parameters, and options, but its own scratch space, node cache, and
+// precomputed keys. Clones derive the same keys as the tree, but never contend
+// with it or with each other, and wiping one doesn't affect the others.
+func (t *KeyedHashTree) Clone() *KeyedHashTree {
+	c := new(KeyedHashTree)
+	c.copyFrom(t)
+	_ = c.precompute() // t's precomputed keys already fit
+	return c
+}
+
+// ErrNoKey is returned when deriving keys from a tree which has no root key,
+// such as a tree which has been unmarshaled but not yet given a key.
+var ErrNoKey = errors.New("kht: tree has no key")
+
+// SetKey sets the tree's root key, applying any passphrase hardening,
+// stretching, and context label the tree was configured with. It's used to
+// supply the root key to a tree which has been unmarshaled, since marshaled
+// trees don't include their keys. It must not be called concurrently with key
+// derivation, and it returns an error if the key is empty or if the tree is a
+// subtree.
+func (t *KeyedHashTree) SetKey(key []byte) error {
+	if len(key) == 0 {
+		return errors.New("kht: key must not be empty")
+	}
+
+	if t.top != 0 {
+		return errors.New("kht: can't set the key of a subtree")
+	}
+
+	owned := false // whether key is a copy, which the tree can wipe
+	if t.argon2 != nil {
+		key, owned = t.harden(key), true
+	}
+
+	if t.stretch > 0 {
+		k := stretch(t.alg, key, t.stretch)
+		if owned {
+			Wipe(key)
+		}
+		key, owned = k, true
+	}
+
+	if len(t.context) > 0 {
+		k := contextualize(t.alg, key, t.context)
+		if owned {
+			Wipe(key)
+		}
+		key, owned = k, true
+	}
+
+	if !owned {
+		key = append([]byte(nil), key...) // the tree wipes its own copy
+	}
+
+	Wipe(t.root)
+	t.root = key
+	if t.cache != nil {
+		t.cache.wipe()
+	}
+	return t.precompute()
+}
+
+// ErrOffsetOutOfRange is returned when an offset is not less than a tree's
+// covered size, or is outside a subtree's range. Errors returned by KeyAt wrap
+// it in an *OffsetError.
+var ErrOffsetOutOfRange = errors.New("kht: offset out of range")
+
+// An OffsetError records an offset which is out of range for a tree.
+type OffsetError struct {
+	Offset  uint64 // the requested offset
+	Base    uint64 // the tree's first offset, which is only non-zero for subtrees
+	MaxSize uint64 // the end of the tree's range, which is its covered size
+}
+
+func (e *OffsetError) Error() string {
+	if e.Offset < e.Base {
+		return fmt.Sprintf("kht: offset %d less than base offset %d", e.Offset, e.Base)
+	}
+	return fmt.Sprintf("kht: offset %d not less than covered size %d", e.Offset, e.MaxSize)
+}
+
+// Unwrap returns ErrOffsetOutOfRange.
+func (e *OffsetError) Unwrap() error {
+	return ErrOffsetOutOfRange
+}
+
+// Key returns the derived key at the given offset. It panics if the offset is
+// not less than the tree's covered size.
 func (t *KeyedHashTree) Key(offset uint64) []byte {
-	if offset > t.maxSize {
+	k, err := t.KeyAt(offset)
+	if err == ErrNoKey {
+		panic("tree has no key")
+	} else if err != nil {
 		panic("offset greater than maximum size")
 	}
+	return k
+}
+
+// KeyAt returns the derived key at the given offset, or an *OffsetError if the
+// offset is not less than the tree's covered size or is outside a subtree's
+// range. It returns ErrNoKey if the tree has no root key. To address a node of
+// any level by its coordinates instead, see NodeKey.
+func (t *KeyedHashTree) KeyAt(offset uint64) ([]byte, error) {
+	if t.root == nil {
+		return nil, ErrNoKey
+	}
+
+	if err := t.checkOffset(offset); err != nil {
+		return nil, err
+	}
+	return t.output(t.leaf(offset)), nil
+}
+
+// Depth returns the number of levels below the root of the tree, which is also
+// the level of its leaves.
+func (t *KeyedHashTree) Depth() uint64 {
+	return t.depth
+}
+
+// LeafCount returns the number of leaves covered by the tree, or, for a
+// subtree, the number of leaves it covers.
+func (t *KeyedHashTree) LeafCount() uint64 {
+	n := t.end() - t.base
+	return n/t.blockSize + min(n%t.blockSize, 1)
+}
+
+// LeafIndex returns the index, within the leaf level, of the leaf containing
+// the given offset. This is the node index used to derive the leaf's key, and
+// the index to pass to NodeKey with a level of Depth(). It doesn't check that
+// the offset is in range.
+func (t *KeyedHashTree) LeafIndex(offset uint64) uint64 {
+	return offset / t.blockSize
+}
+
+// CoveredSize returns the number of bytes covered by the tree's leaves, which
+// is blockSize*factor^depth, saturating at the largest uint64. Every offset
+// less than the covered size is valid, even if it's greater than the maximum
+// size the tree was created with. For a subtree, it returns the end of the
+// subtree's range.
+func (t *KeyedHashTree) CoveredSize() uint64 {
+	return t.limit
+}
+
+// Range returns the range of offsets [start, end) whose keys the tree can
+// derive. For a full tree, that's [0, CoveredSize()); for a subtree, it's the
+// range of the node the subtree is rooted at.
+func (t *KeyedHashTree) Range() (start, end uint64) {
+	return t.base, t.limit
+}
+
+// end returns the offset just past the last byte covered by the tree.
+func (t *KeyedHashTree) end() uint64 {
+	return t.limit
+}
+
+// checkOffset returns an *OffsetError if the given offset is out of range.
+func (t *KeyedHashTree) checkOffset(offset uint64) error {
+	if offset < t.base || offset >= t.limit {
+		return &OffsetError{Offset: offset, Base: t.base, MaxSize: t.limit}
+	}
+	return nil
+}
+
+// KeyN returns n bytes of key material for the given offset, regardless of the
+// output size of the tree's keyed hash or the tree's output length. It panics
+// if n is negative or greater than 255 times the hash size, or if the offset is
+// not less than the tree's covered size.
+//
+// The key material is HKDF-Expand(PRK=leaf, info="kht output", L=n) as defined
+// in RFC 5869, where leaf is the key of the leaf node containing the offset and
+// the tree's keyed hash is used as the PRF: T(1) = H(leaf, info || 0x01), T(i)
+// = H(leaf, T(i-1) || info || i), and the output is the first n bytes of T(1)
+// || T(2) || .... Every node in the tree is derived from a 16-byte message,
+// while each HKDF-Expand message is either 11 bytes long or 11 bytes longer
+// than the hash output, so expanded key material can't collide with a node key.
+func (t *KeyedHashTree) KeyN(offset uint64, n int) []byte {
+	k := t.leaf(offset)
+	defer Wipe(k)
+
+	if n < 0 {
+		panic("negative output length")
+	}
+
+	if n > 255*len(k) {
+		panic("output length greater than 255 times hash size")
+	}
+	return expand(t.alg, k, outputInfo, n)
+}
+
+// output fits the given leaf key to the tree's output length, returning a new
+// slice and wiping k unless k is returned as-is.
+func (t *KeyedHashTree) output(k []byte) []byte {
+	if t.outLen <= 0 {
+		return k
+	}
+	defer Wipe(k)
+
+	out := t.fit(k)
+	if t.policy != HKDFExpand {
+		out = append([]byte(nil), out...)
+	}
+	return out
+}
+
+// fit fits the given leaf key to the tree's output length. Truncated keys are
+// returned as slices of k, while expanded keys are returned as new slices.
+func (t *KeyedHashTree) fit(k []byte) []byte {
+	if t.outLen <= 0 {
+		return k
+	}
+
+	switch t.policy {
+	case Leading:
+		return k[:t.outLen]
+	case Trailing:
+		return k[len(k)-t.outLen:]
+	default:
+		return expand(t.alg, k, outputInfo, t.outLen)
+	}
+}
+
+// Size returns the length of the tree's derived keys, in bytes. This is the
+// output length if one was set, and the output size of the tree's keyed hash
+// otherwise.
+func (t *KeyedHashTree) Size() uint64 {
+	if t.outLen > 0 {
+		return uint64(t.outLen)
+	}
+	return uint64(t.hashSize)
+}
+
+// KeyInto writes the derived key at the given offset into dst and returns the
+// number of bytes written. dst must be at least Size() bytes long. Unless keys
+// are expanded with HKDFExpand, KeyInto doesn't allocate once the tree's
+// scratch space has warmed up. It panics if dst is too small or if the offset
+// is not less than the tree's covered size.
+func (t *KeyedHashTree) KeyInto(dst []byte, offset uint64) int {
+	if uint64(len(dst)) < t.Size() {
+		panic("destination too small")
+	}
+	return len(t.AppendKey(dst[:0], offset))
+}
+
+// AppendKey appends the derived key at the given offset to dst and returns the
+// extended slice. Like KeyInto, it doesn't allocate unless keys are expanded
+// with HKDFExpand or dst lacks the capacity for the key. It panics if the
+// offset is not less than the tree's covered size.
+func (t *KeyedHashTree) AppendKey(dst []byte, offset uint64) []byte {
+	s := t.getScratch()
+	defer t.putScratch(s)
+
+	k := t.fit(t.derive(s, offset, t.depth))
+	if t.outLen > 0 && t.policy == HKDFExpand {
+		defer Wipe(k)
+	}
+	return append(dst, k...)
+}
+
+// leaf returns the key of the leaf node containing the given offset.
+func (t *KeyedHashTree) leaf(offset uint64) []byte {
+	s := t.getScratch()
+	defer t.putScratch(s)
+
+	k := t.derive(s, offset, t.depth)
+	leaf := make([]byte, len(k))
+	copy(leaf, k)
+	return leaf
+}
+
+// scratchSpace holds the state needed to derive a key, so it can be reused
+// across derivations.
+type scratchSpace struct {
+	h   *hmacHash // nil unless the tree's keyed hash is HMAC
+	buf [16]byte
+	k   []byte
+}
+
+func (t *KeyedHashTree) getScratch() *scratchSpace {
+	if s, ok := t.scratch.Get().(*scratchSpace); ok {
+		return s
+	}
+
+	h := t.alg(t.root)
+	s := &scratchSpace{
+		k: make([]byte, 0, max(len(t.root), h.Size())),
+	}
+	if h, ok := h.(*hmacHash); ok {
+		s.h = h
+	}
+	return s
+}
+
+// putScratch wipes the given scratch space and returns it to the pool.
+func (t *KeyedHashTree) putScratch(s *scratchSpace) {
+	Wipe(s.k[:cap(s.k)])
+	if s.h != nil {
+		s.h.wipe()
+	}
+	t.scratch.Put(s)
+}
+
+// derive returns the key of the node at the given level which contains the
+// given offset, using the given scratch space. The returned slice is only valid
+// until the scratch space is reused.
+func (t *KeyedHashTree) derive(s *scratchSpace, offset, level uint64) []byte {
+	if t.root == nil {
+		panic("tree has no key")
+	}
+
+	if t.checkOffset(offset) != nil {
+		panic("offset greater than maximum size")
+	}
+
+	var began time.Time
+	if t.observer != nil {
+		began = time.Now()
+	}
+
+	// Each node's key overwrites its parent's in place, so the only key left in
+	// the scratch space is the one returned.
+	start := t.top
+	if t.cache != nil {
+		start, s.k = t.cache.ancestor(t, s.k[:0], offset, level)
+	}
+
+	if t.pre != nil && start < min(level, t.pre.levels) {
+		start = min(level, t.pre.levels)
+		s.k = append(s.k[:0], t.pre.key(t, start, offset)...)
+	}
+
+	if start == t.top {
+		s.k = append(s.k[:0], t.root...)
+	}
+
+	for i := start; i < level; i++ {
+		y := offset / t.nodeSize(i+1)
+
+		binary.LittleEndian.PutUint64(s.buf[:], uint64(i))
+		binary.LittleEndian.PutUint64(s.buf[8:], uint64(y))
+
+		var h hash.Hash
+		if s.h != nil {
+			s.h.rekey(s.k)
+			h = s.h
+		} else {
+			h = t.alg(s.k)
+		}
+		_, _ = h.Write(s.buf[:])
+		s.k = h.Sum(s.k[:0])
+		if s.h == nil {
+			wipeHash(h)
+		}
+
+		if t.cache != nil && i+1 < t.depth {
+			t.cache.put(nodeID{i + 1, y}, s.k)
+		}
+	}
+
+	if t.observer != nil {
+		d := Derivation{Offset: offset, Level: level, Nodes: 1, Hashes: level - start}
+		if t.cache != nil {
+			d.Cache = CacheMiss
+			if start != t.top {
+				d.Cache = CacheHit
+			}
+		}
+		t.observe(d, began)
+	}
+	return s.k
+}
+
+// nodeSize returns the number of bytes covered by each node at the given level
+// of the tree, where the root is level 0 and the leaves are level depth.
+func (t *KeyedHashTree) nodeSize(level uint64) uint64 {
+	return t.sizes[level]
+}
+
+// nodeSizes returns a table of the number of bytes covered by each node at each
+// level of a tree below the root. The sizes can't overflow: a computed depth is
+// the smallest which covers the maximum size, so the nodes below the root each
+// cover less than the maximum size, and a fixed depth is checked by checkDepth.
+func nodeSizes(blockSize, factor, depth uint64) []uint64 {
+	sizes := make([]uint64, depth+1)
+	if depth == 0 {
+		return sizes
+	}
+
+	sizes[depth] = blockSize
+	for level := depth - 1; level > 0; level-- {
+		sizes[level] = sizes[level+1] * factor
+	}
+	return sizes
+}
+
+var nameTag = []byte("kht block name")
+
+// BlockName returns a short, deterministic, URL-safe name for the block at the
+// given offset, suitable for storing the block without revealing its offset.
+//
+// The name is the unpadded base64url encoding of the first n bytes (see
+// WithNameLength) of the keyed hash of the tag "kht block name" under the
+// block's derived key. Knowing a block's name reveals neither the block's key
+// nor its offset. Names are truncated hashes, so two blocks out of m share a
+// name with a probability of roughly m^2/2^(8n+1); with the default of 16
+// bytes, that is negligible for any realistic number of blocks.
+func (t *KeyedHashTree) BlockName(offset uint64) string {
+	k := t.leaf(offset)
+	defer Wipe(k)
+
+	h := t.alg(k)
+	defer wipeHash(h)
+
+	_, _ = h.Write(nameTag)
+	name := h.Sum(nil)
+	if t.nameLen < len(name) {
+		name = name[:t.nameLen]
+	}
+	return base64.RawURLEncoding.EncodeToString(name)
+}
+
+var outputInfo = []byte("kht output")
+
+// expand returns n bytes of HKDF-Expand output for the given pseudorandom key
+// and info, using the given keyed hash as the PRF.
+func expand(alg KeyedHash, prk, info []byte, n int) []byte {
+	h := alg(prk)
+	defer wipeHash(h)
+
+	out := make([]byte, 0, n+h.Size())
+	var prev []byte
+	for i := byte(1); len(out) < n; i++ {
+		h.Reset()
+		_, _ = h.Write(prev)
+		_, _ = h.Write(info)
+		_, _ = h.Write([]byte{i})
+		prev = h.Sum(prev[:0])
+		out = append(out, prev...)
+	}
+	Wipe(prev)
+	Wipe(out[n:])
+	return out[:n]
+}
+
+var contextTag = []byte("kht context")
+
+// contextualize returns the root key for a tree with the given context label.
+func contextualize(alg KeyedHash, key, label []byte) []byte {
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(label)))
+
+	h := alg(key)
+	defer wipeHash(h)
+
+	_, _ = h.Write(contextTag)
+	_, _ = h.Write(n[:])
+	_, _ = h.Write(label)
+	return h.Sum(nil)
+}
+
+var stretchSalt = []byte("kht root stretch")
 
-	buf := make([]byte, 16)
-	k := make([]byte, len(t.root))
-	copy(k, t.root)
-	for i := uint64(0); i < t.depth; i++ {
-		level := t.depth - i
-		blockSize := uint64(math.Pow(t.factor, float64(level-1))) * t.blockSize
-		y := offset / blockSize
+// stretch returns the first block of PBKDF2 using the given keyed hash as the
+// PRF, a fixed salt, and the given number of iterations.
+func stretch(alg KeyedHash, key []byte, iterations int) []byte {
+	h := alg(key)
+	defer wipeHash(h)
 
-		binary.LittleEndian.PutUint64(buf, uint64(i))
-		binary.LittleEndian.PutUint64(buf[8:], uint64(y))
+	_, _ = h.Write(stretchSalt)
+	_, _ = h.Write([]byte{0, 0, 0, 1})
+	u := h.Sum(nil)
 
-		h := t.alg(k)
-		_, _ = h.Write(buf)
-		k = h.Sum(k[:0])
+	k := make([]byte, len(u))
+	copy(k, u)
+	for i := 1; i < iterations; i++ {
+		h.Reset()
+		_, _ = h.Write(u)
+		u = h.Sum(u[:0])
+		for j := range k {
+			k[j] ^= u[j]
+		}
 	}
+	Wipe(u)
 	return k
 }
@@ -2,13 +2,30 @@ package kht_test
 
 import (
 	"bytes"
+	"crypto/hkdf"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/pbkdf2"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
 	"testing"
 
 	"github.com/codahale/kht"
 )
 
+func mustNew(tb testing.TB, key []byte, alg kht.KeyedHash, blockSize, maxSize uint64, factor float64, opts ...kht.Option) *kht.KeyedHashTree {
+	tb.Helper()
+
+	tree, err := kht.New(key, alg, blockSize, maxSize, factor, opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return tree
+}
+
 func TestKey(t *testing.T) {
 	keys := [][]byte{
 		{0x3a, 0xbe, 0x2f, 0xa3, 0xa0, 0xac, 0x9b, 0xa2, 0xa7, 0x4d, 0x17, 0xd4, 0x10, 0xb1, 0x30, 0x6},
@@ -30,7 +47,7 @@ func TestKey(t *testing.T) {
 	}
 
 	n := uint64(16)
-	tree := kht.New([]byte("yay"), kht.HMAC(md5.New), 2, n, 8)
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, n, 8)
 	for i := uint64(0); i < n; i++ {
 		if v, want := tree.Key(i), keys[i]; !bytes.Equal(v, want) {
 			t.Errorf("Key %d was %#v, but expected %#v", i, v, want)
@@ -38,6 +55,118 @@ func TestKey(t *testing.T) {
 	}
 }
 
+func TestNewInt(t *testing.T) {
+	for _, factor := range []uint64{2, 8, 1024} {
+		tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 16, 1<<24, float64(factor))
+		intTree, err := kht.NewInt([]byte("yay"), kht.HMAC(md5.New), 16, 1<<24, factor)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v, want := intTree.Depth(), tree.Depth(); v != want {
+			t.Errorf("Depth with factor %d was %d, but expected %d", factor, v, want)
+		}
+
+		for _, offset := range []uint64{0, 15, 16, 1 << 20, 1<<24 - 1} {
+			if v, want := intTree.Key(offset), tree.Key(offset); !bytes.Equal(v, want) {
+				t.Errorf("Key %d with factor %d was %#v, but expected %#v", offset, factor, v, want)
+			}
+		}
+	}
+
+	if _, err := kht.NewInt([]byte("yay"), kht.HMAC(md5.New), 16, 1<<24, 1); err == nil {
+		t.Error("No error for a factor of 1, but expected one")
+	}
+}
+
+func TestKeyLargeTree(t *testing.T) {
+	// 3^34 can't be represented as a float64, so a tree with a branching factor
+	// of 3 and a maximum size above 2^53 has nodes whose sizes can't either.
+	pow := uint64(1)
+	for i := 0; i < 34; i++ {
+		pow *= 3
+	}
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 4*pow, 3)
+
+	for _, offset := range []uint64{0, 2*pow - 2, 2*pow - 1, 2 * pow, 4*pow - 1} {
+		k := []byte("yay")
+		for i := uint64(0); i < 35; i++ {
+			size := uint64(2)
+			for j := i + 1; j < 35; j++ {
+				size *= 3
+			}
+
+			buf := make([]byte, 16)
+			binary.LittleEndian.PutUint64(buf, i)
+			binary.LittleEndian.PutUint64(buf[8:], offset/size)
+
+			h := hmac.New(md5.New, k)
+			_, _ = h.Write(buf)
+			k = h.Sum(nil)
+		}
+
+		if v := tree.Key(offset); !bytes.Equal(v, k) {
+			t.Errorf("Key %d was %#v, but expected %#v", offset, v, k)
+		}
+	}
+}
+
+func TestGeometry(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 17, 4)
+
+	if v, want := tree.Depth(), uint64(2); v != want {
+		t.Errorf("Depth was %d, but expected %d", v, want)
+	}
+
+	if v, want := tree.LeafCount(), uint64(16); v != want {
+		t.Errorf("Leaf count was %d, but expected %d", v, want)
+	}
+
+	if v, want := tree.CoveredSize(), uint64(32); v != want {
+		t.Errorf("Covered size was %d, but expected %d", v, want)
+	}
+
+	for offset := uint64(0); offset < 32; offset++ {
+		leaf, err := tree.NodeKey(tree.Depth(), tree.LeafIndex(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := tree.Key(offset); !bytes.Equal(leaf, want) {
+			t.Errorf("Leaf for %d was %#v, but expected %#v", offset, leaf, want)
+		}
+	}
+}
+
+func TestGeometryExtremes(t *testing.T) {
+	tests := []struct {
+		blockSize, maxSize, factor uint64
+		depth, covered             uint64
+	}{
+		{1, math.MaxUint64, 2, 64, math.MaxUint64},
+		{1, 1 << 63, 2, 63, 1 << 63},
+		{1<<53 + 1, 1<<60 + 3, 7, 3, (1<<53 + 1) * 343},
+		{4096, 1 << 50, 1000, 4, 4096 * 1000 * 1000 * 1000 * 1000},
+		{512, 512, 1 << 40, 0, 512},
+		{1, math.MaxUint64, math.MaxUint64, 1, math.MaxUint64},
+	}
+
+	for _, test := range tests {
+		tree, err := kht.NewInt([]byte("yay"), kht.HMAC(md5.New), test.blockSize, test.maxSize, test.factor)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v := tree.Depth(); v != test.depth {
+			t.Errorf("Depth of %+v was %d, but expected %d", test, v, test.depth)
+		}
+
+		if v := tree.CoveredSize(); v != test.covered {
+			t.Errorf("Covered size of %+v was %d, but expected %d", test, v, test.covered)
+		}
+	}
+}
+
 func TestOffsetTooGreat(t *testing.T) {
 	defer func() {
 		e := recover()
@@ -46,13 +175,518 @@ func TestOffsetTooGreat(t *testing.T) {
 		}
 	}()
 
-	tree := kht.New([]byte("yay"), kht.HMAC(md5.New), 2, 100, 8)
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 100, 8)
 	tree.Key(1000)
 	t.Error("No panic, but expected one")
 }
 
+func TestKeyAtOutOfRange(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 100, 8)
+
+	k, err := tree.KeyAt(1000)
+	if k != nil {
+		t.Errorf("Key was %#v, but expected nil", k)
+	}
+
+	if !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+
+	var e *kht.OffsetError
+	if !errors.As(err, &e) || e.Offset != 1000 || e.MaxSize != 128 {
+		t.Errorf("Error was %#v, but expected offset 1000 and max size 128", err)
+	}
+
+	if k, err := tree.KeyAt(127); err != nil || !bytes.Equal(k, tree.Key(127)) {
+		t.Errorf("KeyAt(127) was %#v, %v, but expected %#v", k, err, tree.Key(127))
+	}
+
+	if _, err := tree.KeyAt(128); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+}
+
+func TestRootStretch(t *testing.T) {
+	root, err := pbkdf2.Key(md5.New, "yay", []byte("kht root stretch"), 1000, md5.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stretched := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8, kht.WithRootStretch(1000))
+	plain := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8)
+	expected := mustNew(t, root, kht.HMAC(md5.New), 2, 16, 8)
+
+	for i := uint64(0); i < 16; i++ {
+		if v, want := stretched.Key(i), expected.Key(i); !bytes.Equal(v, want) {
+			t.Errorf("Key %d was %#v, but expected %#v", i, v, want)
+		}
+
+		if v := stretched.Key(i); bytes.Equal(v, plain.Key(i)) {
+			t.Errorf("Key %d was the same as the unstretched key", i)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	plain := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8)
+	empty := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8, kht.WithContext(nil))
+	a := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8, kht.WithContext([]byte("data")))
+	b := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8, kht.WithContext([]byte("metadata")))
+	c := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8, kht.WithContext([]byte("data")))
+
+	for i := uint64(0); i < 16; i++ {
+		if v, want := empty.Key(i), plain.Key(i); !bytes.Equal(v, want) {
+			t.Errorf("Key %d was %#v, but expected %#v", i, v, want)
+		}
+
+		if v, want := c.Key(i), a.Key(i); !bytes.Equal(v, want) {
+			t.Errorf("Key %d was %#v, but expected %#v", i, v, want)
+		}
+
+		if bytes.Equal(a.Key(i), plain.Key(i)) || bytes.Equal(a.Key(i), b.Key(i)) {
+			t.Errorf("Key %d was the same across contexts", i)
+		}
+	}
+
+	for level := uint64(0); level <= a.Depth(); level++ {
+		ka, err := a.NodeKey(level, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kb, err := b.NodeKey(level, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Equal(ka, kb) {
+			t.Errorf("Node (%d, 0) was the same across contexts", level)
+		}
+	}
+}
+
+func TestBlockName(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8)
+
+	names := make(map[string]uint64)
+	for i := uint64(0); i < 16; i += 2 {
+		name := tree.BlockName(i)
+		if len(name) != 22 {
+			t.Errorf("Name for %d was %q, which is %d characters long", i, name, len(name))
+		}
+
+		if j, ok := names[name]; ok {
+			t.Errorf("Blocks %d and %d have the same name: %q", i, j, name)
+		}
+		names[name] = i
+
+		if v := tree.BlockName(i + 1); v != name {
+			t.Errorf("Name for %d was %q, but expected %q", i+1, v, name)
+		}
+	}
+
+	short := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8, kht.WithNameLength(6))
+	if v, want := short.BlockName(0), tree.BlockName(0)[:8]; v != want {
+		t.Errorf("Short name was %q, but expected %q", v, want)
+	}
+}
+
+func TestKeyN(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8)
+	for _, n := range []int{8, 16, 32, 100} {
+		want, err := hkdf.Expand(md5.New, tree.Key(6), "kht output", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v := tree.KeyN(6, n); !bytes.Equal(v, want) {
+			t.Errorf("%d-byte key was %#v, but expected %#v", n, v, want)
+		}
+	}
+}
+
+func TestKeyNNegative(t *testing.T) {
+	defer func() {
+		e := recover()
+		if e != "negative output length" {
+			t.Errorf("Panic was %v, which is weird", e)
+		}
+	}()
+
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8)
+	tree.KeyN(6, -1)
+	t.Error("No panic, but expected one")
+}
+
+func TestOutputLength(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8)
+	leaf := tree.Key(0)
+
+	leading := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8,
+		kht.WithOutputLength(10, kht.Leading))
+	if v, want := leading.Key(0), leaf[:10]; !bytes.Equal(v, want) {
+		t.Errorf("Leading key was %#v, but expected %#v", v, want)
+	}
+
+	trailing := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8,
+		kht.WithOutputLength(10, kht.Trailing))
+	if v, want := trailing.Key(0), leaf[6:]; !bytes.Equal(v, want) {
+		t.Errorf("Trailing key was %#v, but expected %#v", v, want)
+	}
+
+	want, err := hkdf.Expand(md5.New, leaf, "kht output", 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expanded := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8,
+		kht.WithOutputLength(40, kht.HKDFExpand))
+	if v := expanded.Key(0); !bytes.Equal(v, want) {
+		t.Errorf("Expanded key was %#v, but expected %#v", v, want)
+	}
+}
+
+func TestKeyLength(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4, kht.WithKeyLength(64))
+	expanded := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4,
+		kht.WithOutputLength(64, kht.HKDFExpand))
+
+	if v, want := tree.Key(100), expanded.Key(100); !bytes.Equal(v, want) {
+		t.Errorf("Key was %#v, but expected %#v", v, want)
+	}
+
+	if v := tree.Size(); v != 64 {
+		t.Errorf("Size was %d, but expected 64", v)
+	}
+
+	if v, want := tree.Key(100)[:32], tree.KeyN(100, 32); !bytes.Equal(v, want) {
+		t.Errorf("Key prefix was %#v, but expected %#v", v, want)
+	}
+}
+
+func TestNewTree(t *testing.T) {
+	tree, err := kht.NewTree([]byte("yay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 4096, 1<<42, 1024)
+	for _, offset := range []uint64{0, 1 << 30, 1<<42 - 1} {
+		if v, want := tree.Key(offset), want.Key(offset); !bytes.Equal(v, want) {
+			t.Errorf("Key for %d was %#v, but expected %#v", offset, v, want)
+		}
+	}
+
+	if v := tree.Depth(); v != 3 {
+		t.Errorf("Depth was %d, but expected 3", v)
+	}
+
+	custom, err := kht.NewTree([]byte("yay"),
+		kht.WithHash(kht.HMAC(md5.New)),
+		kht.WithBlockSize(2),
+		kht.WithMaxSize(100),
+		kht.WithBranchingFactor(8),
+		kht.WithKeyLength(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 100, 8, kht.WithKeyLength(20))
+	if v, want := custom.Key(99), want.Key(99); !bytes.Equal(v, want) {
+		t.Errorf("Key was %#v, but expected %#v", v, want)
+	}
+}
+
+func TestNewTreeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		key  []byte
+		opts []kht.Option
+		err  string
+	}{
+		{"empty key", nil, nil, "kht: key must not be empty"},
+		{"nil hash", []byte("yay"), []kht.Option{kht.WithHash(nil)}, "kht: alg must not be nil"},
+		{"zero block size", []byte("yay"), []kht.Option{kht.WithBlockSize(0)}, "kht: blockSize must be greater than zero"},
+		{"swapped sizes", []byte("yay"), []kht.Option{kht.WithBlockSize(1 << 20), kht.WithMaxSize(4096)},
+			"kht: maxSize must not be less than blockSize"},
+		{"factor of 1", []byte("yay"), []kht.Option{kht.WithBranchingFactor(1)}, "kht: factor must be greater than 1"},
+	}
+
+	for _, test := range tests {
+		_, err := kht.NewTree(test.key, test.opts...)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("Error for %s was %v, but expected %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestNewWithDepth(t *testing.T) {
+	tree, err := kht.NewWithDepth([]byte("yay"), kht.HMAC(md5.New), 2, 4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := tree.CoveredSize(), uint64(128); v != want {
+		t.Errorf("Covered size was %d, but expected %d", v, want)
+	}
+
+	want := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 128, 4)
+	for _, offset := range []uint64{0, 63, 127} {
+		if v, want := tree.Key(offset), want.Key(offset); !bytes.Equal(v, want) {
+			t.Errorf("Key at %d was %#v, but expected %#v", offset, v, want)
+		}
+	}
+
+	if _, err := tree.KeyAt(128); err == nil {
+		t.Error("Derived a key past the tree's capacity")
+	}
+
+	// A tree whose capacity overflows covers every offset.
+	huge, err := kht.NewWithDepth([]byte("yay"), kht.HMAC(md5.New), 4096, 1024, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := huge.Depth(), uint64(6); v != want {
+		t.Errorf("Depth was %d, but expected %d", v, want)
+	}
+
+	if v, want := huge.CoveredSize(), uint64(math.MaxUint64); v != want {
+		t.Errorf("Covered size was %d, but expected %d", v, want)
+	}
+
+	if _, err := huge.KeyAt(math.MaxUint64 - 1); err != nil {
+		t.Error(err)
+	}
+
+	leaf, err := kht.NewWithDepth([]byte("yay"), kht.HMAC(md5.New), 2, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := leaf.Key(1), []byte("yay"); !bytes.Equal(v, want) {
+		t.Errorf("Key was %#v, but expected %#v", v, want)
+	}
+
+	if _, err := kht.NewWithDepth([]byte("yay"), kht.HMAC(md5.New), 4096, 1024, 7); err == nil {
+		t.Error("Created a tree with nodes too large to count")
+	}
+
+	if _, err := kht.NewWithDepth([]byte("yay"), kht.HMAC(md5.New), 2, 1, 3); err == nil {
+		t.Error("Created a tree with a branching factor of 1")
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := []struct {
+		name               string
+		key                []byte
+		blockSize, maxSize uint64
+		factor             float64
+		opts               []kht.Option
+		err                string
+	}{
+		{"empty key", nil, 2, 16, 8, nil, "kht: key must not be empty"},
+		{"zero block size", []byte("yay"), 0, 16, 8, nil, "kht: blockSize must be greater than zero"},
+		{"small max size", []byte("yay"), 32, 16, 8, nil, "kht: maxSize must not be less than blockSize"},
+		{"factor of 1", []byte("yay"), 2, 16, 1, nil, "kht: factor must be greater than 1"},
+		{"NaN factor", []byte("yay"), 2, 16, math.NaN(), nil, "kht: factor must be greater than 1"},
+		{"tiny factor", []byte("yay"), 1, math.MaxUint64, 1.0000001, nil, "kht: factor must be an integer"},
+		{"fractional factor", []byte("yay"), 2, 16, 2.5, nil, "kht: factor must be an integer"},
+		{"long truncation", []byte("yay"), 2, 16, 8,
+			[]kht.Option{kht.WithOutputLength(17, kht.Leading)},
+			"kht: output length must not be greater than the hash size"},
+		{"long expansion", []byte("yay"), 2, 16, 8,
+			[]kht.Option{kht.WithOutputLength(255*16+1, kht.HKDFExpand)},
+			"kht: output length must not be greater than 255 times the hash size"},
+		{"unknown policy", []byte("yay"), 2, 16, 8,
+			[]kht.Option{kht.WithOutputLength(8, kht.TruncatePolicy(3))},
+			"kht: unknown truncate policy 3"},
+	}
+
+	for _, test := range tests {
+		_, err := kht.New(test.key, kht.HMAC(md5.New), test.blockSize, test.maxSize, test.factor, test.opts...)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("Error for %s was %v, but expected %q", test.name, err, test.err)
+		}
+	}
+
+	if _, err := kht.New([]byte("yay"), nil, 2, 16, 8); err == nil || err.Error() != "kht: alg must not be nil" {
+		t.Errorf("Error for nil alg was %v", err)
+	}
+}
+
+func TestKeyAtNeverPanics(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 100, 8)
+	sub, err := tree.Subtree(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range []uint64{0, 15, 16, 31, 32, 127, 128, math.MaxUint64} {
+		for _, tree := range []*kht.KeyedHashTree{tree, sub} {
+			k, err := tree.KeyAt(offset)
+			if (k == nil) == (err == nil) {
+				t.Errorf("KeyAt(%d) returned %#v and %v", offset, k, err)
+			}
+		}
+	}
+}
+
+func TestConcurrentKey(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 1024, 4)
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = tree.Key(uint64(i))
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			dst := make([]byte, md5.Size)
+			for i := range keys {
+				offset := uint64((i + g*64) % len(keys))
+				if v := tree.Key(offset); !bytes.Equal(v, keys[offset]) {
+					t.Errorf("Key %d was %#v, but expected %#v", offset, v, keys[offset])
+				}
+
+				tree.KeyInto(dst, offset)
+				if !bytes.Equal(dst, keys[offset]) {
+					t.Errorf("Key %d was %#v, but expected %#v", offset, dst, keys[offset])
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentKeyOptions(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 1024, 4)
+	keys := tree.Keys(0, 512)
+
+	options := map[string][]kht.Option{
+		"cache":      {kht.WithNodeCache(8)},
+		"precompute": {kht.WithPrecompute(2)},
+		"observer":   {kht.WithObserver(new(recorder))},
+		"batch":      {kht.WithBatchHash(kht.ParallelBatch(kht.HMAC(md5.New)))},
+	}
+	for name, opts := range options {
+		t.Run(name, func(t *testing.T) {
+			shared := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 1024, 4, opts...)
+
+			var wg sync.WaitGroup
+			for g := range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					for _, tree := range []*kht.KeyedHashTree{shared, shared.Clone()} {
+						for i := range keys {
+							offset := uint64((i+g*64)%len(keys)) * 2
+							if v := tree.Key(offset); !bytes.Equal(v, keys[offset/2]) {
+								t.Errorf("Key %d was %#v, but expected %#v", offset, v, keys[offset/2])
+							}
+						}
+
+						for i, k := range tree.Keys(uint64(g)*64, 64) {
+							if want := keys[g*32+i]; !bytes.Equal(k, want) {
+								t.Errorf("Key %d was %#v, but expected %#v", g*64+i*2, k, want)
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestClone(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 1024, 4, kht.WithNodeCache(8), kht.WithPrecompute(1))
+	clone := tree.Clone()
+
+	for offset := uint64(0); offset < 1024; offset += 37 {
+		if v, want := clone.Key(offset), tree.Key(offset); !bytes.Equal(v, want) {
+			t.Errorf("Key at %d was %#v, but expected %#v", offset, v, want)
+		}
+	}
+
+	if v, want := clone.CacheStats(), tree.CacheStats(); v.Entries == 0 || v.Hits+v.Misses != want.Hits+want.Misses {
+		t.Errorf("Clone's cache stats were %+v, with the tree's %+v", v, want)
+	}
+
+	clone.Wipe()
+	if _, err := tree.KeyAt(0); err != nil {
+		t.Errorf("Wiping a clone wiped the tree: %v", err)
+	}
+}
+
+func TestSize(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8)
+	if v, want := tree.Size(), uint64(len(tree.Key(0))); v != want {
+		t.Errorf("Size was %d, but expected %d", v, want)
+	}
+
+	tree = mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 2, 16, 8)
+	if v, want := tree.Size(), uint64(sha256.Size); v != want {
+		t.Errorf("Size was %d, but expected %d", v, want)
+	}
+
+	tree = mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 2, 16, 8,
+		kht.WithOutputLength(64, kht.HKDFExpand))
+	if v, want := tree.Size(), uint64(len(tree.Key(0))); v != want {
+		t.Errorf("Size was %d, but expected %d", v, want)
+	}
+}
+
+func TestKeyInto(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8)
+
+	dst := make([]byte, md5.Size)
+	for i := uint64(0); i < 16; i++ {
+		if n := tree.KeyInto(dst, i); n != md5.Size {
+			t.Errorf("Wrote %d bytes for %d, but expected %d", n, i, md5.Size)
+		}
+
+		if want := tree.Key(i); !bytes.Equal(dst, want) {
+			t.Errorf("Key %d was %#v, but expected %#v", i, dst, want)
+		}
+	}
+}
+
+func TestAppendKey(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8)
+
+	var keys []byte
+	for i := uint64(0); i < 16; i += 2 {
+		keys = tree.AppendKey(keys, i)
+	}
+
+	for i := uint64(0); i < 8; i++ {
+		if v, want := keys[i*md5.Size:(i+1)*md5.Size], tree.Key(i*2); !bytes.Equal(v, want) {
+			t.Errorf("Key %d was %#v, but expected %#v", i*2, v, want)
+		}
+	}
+}
+
+func TestKeyIntoTooSmall(t *testing.T) {
+	defer func() {
+		e := recover()
+		if e != "destination too small" {
+			t.Errorf("Panic was %v, which is weird", e)
+		}
+	}()
+
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8)
+	tree.KeyInto(make([]byte, 8), 0)
+	t.Error("No panic, but expected one")
+}
+
 func BenchmarkKey(b *testing.B) {
-	tree := kht.New(make([]byte, 32), kht.HMAC(sha256.New), 1024, 1<<32, 1024)
+	tree := mustNew(b, make([]byte, 32), kht.HMAC(sha256.New), 1024, 1<<32, 1024)
 	b.ReportAllocs()
 	b.ResetTimer()
 
@@ -60,3 +694,47 @@ func BenchmarkKey(b *testing.B) {
 		tree.Key(0)
 	}
 }
+
+func BenchmarkKeyParallel(b *testing.B) {
+	shared := mustNew(b, make([]byte, 32), kht.HMAC(sha256.New), 1024, 1<<32, 1024, kht.WithNodeCache(1024))
+	for name, clone := range map[string]bool{"shared": false, "clones": true} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				tree := shared
+				if clone {
+					tree = shared.Clone()
+				}
+
+				dst := make([]byte, sha256.Size)
+				for offset := uint64(0); pb.Next(); offset += 1024 {
+					tree.KeyInto(dst, offset%(1<<32))
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkKeyInto(b *testing.B) {
+	tree := mustNew(b, make([]byte, 32), kht.HMAC(sha256.New), 1024, 1<<32, 1024)
+	dst := make([]byte, sha256.Size)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		tree.KeyInto(dst, 0)
+	}
+}
+
+func BenchmarkAppendKey(b *testing.B) {
+	tree := mustNew(b, make([]byte, 32), kht.HMAC(sha256.New), 1024, 1<<32, 1024)
+	dst := make([]byte, 0, sha256.Size)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		dst = tree.AppendKey(dst[:0], uint64(i)*1024)
+	}
+}
@@ -0,0 +1,124 @@
+package kht
+
+import (
+	"crypto/sha3"
+	"hash"
+)
+
+// KMAC returns a keyed hash implementation using KMAC128 or KMAC256 (NIST SP
+// 800-185), for environments which require an approved keyed hash. The
+// security strength must be 128 or 256 bits; KMAC128 produces 32-byte node
+// keys and KMAC256 produces 64-byte node keys. The customization string is
+// passed to KMAC as S, so trees which share a root key but use different
+// customization strings derive independent keys. KMAC panics if the security
+// strength is neither 128 nor 256.
+//
+// Like HKDF, the returned hash.Hash buffers everything written to it until Sum
+// is called.
+func KMAC(securityBits int, customization []byte) KeyedHash {
+	var rate, size int
+	switch securityBits {
+	case 128:
+		rate, size = 168, 32
+	case 256:
+		rate, size = 136, 64
+	default:
+		panic("kht: KMAC security strength must be 128 or 256 bits")
+	}
+
+	s := append([]byte(nil), customization...)
+	return func(key []byte) hash.Hash {
+		return &kmacHash{
+			key:  append([]byte(nil), key...),
+			s:    s,
+			rate: rate,
+			size: size,
+		}
+	}
+}
+
+// kmacHash adapts KMAC to hash.Hash, buffering the message until Sum.
+type kmacHash struct {
+	key, s, msg []byte
+	rate, size  int
+}
+
+var kmacName = []byte("KMAC")
+
+func (h *kmacHash) Write(p []byte) (int, error) {
+	h.msg = append(h.msg, p...)
+	return len(p), nil
+}
+
+func (h *kmacHash) Sum(b []byte) []byte {
+	var c *sha3.SHAKE
+	if h.rate == 168 {
+		c = sha3.NewCSHAKE128(kmacName, h.s)
+	} else {
+		c = sha3.NewCSHAKE256(kmacName, h.s)
+	}
+
+	// newX = bytepad(encode_string(K), rate) || X || right_encode(L)
+	k := leftEncode(nil, uint64(h.rate))
+	k = leftEncode(k, uint64(len(h.key))*8)
+	k = append(k, h.key...)
+	k = append(k, make([]byte, (h.rate-len(k)%h.rate)%h.rate)...)
+	_, _ = c.Write(k)
+	Wipe(k)
+
+	_, _ = c.Write(h.msg)
+	_, _ = c.Write(rightEncode(uint64(h.size) * 8))
+
+	out := make([]byte, h.size)
+	_, _ = c.Read(out)
+	c.Reset()
+	return append(b, out...)
+}
+
+func (h *kmacHash) Reset() {
+	h.msg = h.msg[:0]
+}
+
+func (h *kmacHash) Size() int {
+	return h.size
+}
+
+func (h *kmacHash) BlockSize() int {
+	return h.rate
+}
+
+// wipe zeroes the key and the buffered message.
+func (h *kmacHash) wipe() {
+	Wipe(h.key)
+	Wipe(h.msg)
+}
+
+// leftEncode appends the left_encode of x (SP 800-185) to b.
+func leftEncode(b []byte, x uint64) []byte {
+	n := encodedLen(x)
+	b = append(b, byte(n))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(x>>(8*i)))
+	}
+	return b
+}
+
+// rightEncode returns the right_encode of x (SP 800-185).
+func rightEncode(x uint64) []byte {
+	n := encodedLen(x)
+	b := make([]byte, 0, n+1)
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(x>>(8*i)))
+	}
+	return append(b, byte(n))
+}
+
+// encodedLen returns the number of bytes needed to encode x, which is at
+// least one.
+func encodedLen(x uint64) int {
+	n := 1
+	for x >>= 8; x > 0; x >>= 8 {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,66 @@
+package kht_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestKMAC(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = 0x40 + byte(i)
+	}
+
+	// The KMAC samples from NIST's SP 800-185 examples.
+	tests := []struct {
+		bits int
+		s    string
+		want string
+	}{
+		{128, "", "e5780b0d3ea6f7d3a429c5706aa43a00fadbd7d49628839e3187243f456ee14e"},
+		{128, "My Tagged Application", "3b1fba963cd8b0b59e8c1a6d71888b7143651af8ba0a7070c0979e2811324aa5"},
+		{256, "My Tagged Application", "20c570c31346f703c9ac36c61c03cb64c3970d0cfc787e9b79599d273a68d2f7" +
+			"f69d4cc3de9d104a351689f27cf6f5951f0103f33f4f24871024d9c27773a8dd"},
+	}
+
+	for _, test := range tests {
+		h := kht.KMAC(test.bits, []byte(test.s))(key)
+		_, _ = h.Write([]byte{0, 1, 2, 3})
+		if v := hex.EncodeToString(h.Sum(nil)); v != test.want {
+			t.Errorf("KMAC%d(%q) was %s, but expected %s", test.bits, test.s, v, test.want)
+		}
+
+		h.Reset()
+		_, _ = h.Write([]byte{0, 1})
+		_, _ = h.Write([]byte{2, 3})
+		if v := hex.EncodeToString(h.Sum(nil)); v != test.want {
+			t.Errorf("KMAC%d(%q) after Reset was %s, but expected %s", test.bits, test.s, v, test.want)
+		}
+	}
+}
+
+func TestKMACCustomization(t *testing.T) {
+	a := mustNew(t, []byte("yay"), kht.KMAC(128, []byte("a")), 16, 1024, 4)
+	b := mustNew(t, []byte("yay"), kht.KMAC(128, []byte("b")), 16, 1024, 4)
+
+	if bytes.Equal(a.Key(0), b.Key(0)) {
+		t.Error("Trees with different customization strings derived the same key")
+	}
+
+	if n := len(a.Key(0)); n != 32 {
+		t.Errorf("Key was %d bytes, but expected 32", n)
+	}
+}
+
+func TestKMACInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("No panic, but expected one")
+		}
+	}()
+
+	kht.KMAC(192, nil)
+}
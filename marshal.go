@@ -0,0 +1,261 @@
+package kht
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+var (
+	probeKey = []byte("kht probe key")
+	probeMsg = []byte("kht probe message")
+)
+
+type registeredHash struct {
+	name        string
+	alg         KeyedHash
+	fingerprint []byte
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   []registeredHash
+)
+
+func init() {
+	RegisterKeyedHash("HMAC-MD5", HMAC(md5.New))
+	RegisterKeyedHash("HMAC-SHA1", HMAC(sha1.New))
+	RegisterKeyedHash("HMAC-SHA256", HMAC(sha256.New))
+	RegisterKeyedHash("HMAC-SHA512", HMAC(sha512.New))
+	RegisterKeyedHash("HKDF-SHA256", HKDF(sha256.New))
+	RegisterKeyedHash("BLAKE2b-256", BLAKE2b())
+	RegisterKeyedHash("BLAKE3", BLAKE3())
+}
+
+// RegisterKeyedHash registers a keyed hash under the given name, so that trees
+// which use it can be marshaled and unmarshaled. HMAC-MD5, HMAC-SHA1,
+// HMAC-SHA256, HMAC-SHA512, HKDF-SHA256, BLAKE2b-256, and BLAKE3 are
+// registered by default.
+//
+// Functions can't be compared in Go, so a tree's keyed hash is identified by
+// its output for a fixed key and message: any keyed hash which behaves like a
+// registered one is marshaled under that one's name. RegisterKeyedHash panics
+// if the name is already registered.
+func RegisterKeyedHash(name string, alg KeyedHash) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, r := range registry {
+		if r.name == name {
+			panic("kht: keyed hash " + name + " already registered")
+		}
+	}
+	registry = append(registry, registeredHash{
+		name:        name,
+		alg:         alg,
+		fingerprint: fingerprint(alg),
+	})
+}
+
+func fingerprint(alg KeyedHash) []byte {
+	h := alg(probeKey)
+	_, _ = h.Write(probeMsg)
+	return h.Sum(nil)
+}
+
+// hashName returns the registered name of the given keyed hash.
+func hashName(alg KeyedHash) (string, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	f := fingerprint(alg)
+	for _, r := range registry {
+		if bytes.Equal(r.fingerprint, f) {
+			return r.name, nil
+		}
+	}
+	return "", errors.New("kht: unregistered keyed hash")
+}
+
+// lookupHash returns the keyed hash registered with the given name.
+func lookupHash(name string) (KeyedHash, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for _, r := range registry {
+		if r.name == name {
+			return r.alg, nil
+		}
+	}
+	return nil, fmt.Errorf("kht: unregistered keyed hash %q", name)
+}
+
+const encodingVersion = 1
+
+var errInvalidEncoding = errors.New("kht: invalid tree encoding")
+
+// MarshalBinary encodes the tree's parameters: its block size, maximum size,
+// branching factor, depth, the registered name of its keyed hash, its options,
+// and any passphrase hardening parameters and salt.
+// The root key is not included, so the encoding can be stored alongside the
+// data the tree's keys encrypt. Subtrees can't be marshaled.
+func (t *KeyedHashTree) MarshalBinary() ([]byte, error) {
+	if t.top != 0 {
+		return nil, errors.New("kht: can't marshal a subtree")
+	}
+
+	name, err := hashName(t.alg)
+	if err != nil {
+		return nil, err
+	}
+
+	b := []byte{encodingVersion}
+	b = binary.AppendUvarint(b, t.blockSize)
+	b = binary.AppendUvarint(b, t.maxSize)
+	b = binary.AppendUvarint(b, t.factor)
+	b = appendBytes(b, []byte(name))
+	b = binary.AppendUvarint(b, uint64(max(t.stretch, 0)))
+	b = appendBytes(b, t.context)
+	b = binary.AppendUvarint(b, uint64(max(t.outLen, 0)))
+	b = append(b, byte(t.policy))
+	b = binary.AppendUvarint(b, uint64(t.nameLen))
+	b = binary.AppendUvarint(b, t.depth)
+	if t.argon2 == nil {
+		b = append(b, 0)
+	} else {
+		b = append(b, 1)
+		b = binary.AppendUvarint(b, uint64(t.argon2.Time))
+		b = binary.AppendUvarint(b, uint64(t.argon2.Memory))
+		b = append(b, t.argon2.Threads)
+		b = appendBytes(b, t.salt)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes tree parameters encoded by MarshalBinary into the
+// tree. The tree has no root key afterwards, and it can't derive keys until one
+// is supplied with SetKey. It returns an error if the encoding's root stretch
+// or Argon2 costs are greater than MaxRootStretch, MaxArgon2Time, or
+// MaxArgon2Memory, so setting a key on a tree decoded from untrusted data does
+// a bounded amount of work.
+func (t *KeyedHashTree) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errInvalidEncoding
+	}
+
+	if data[0] != encodingVersion {
+		return fmt.Errorf("kht: unsupported tree encoding version %d", data[0])
+	}
+
+	d := decoder{data: data[1:]}
+	blockSize := d.uvarint()
+	maxSize := d.uvarint()
+	factor := d.uvarint()
+	name := d.bytes()
+	iterations := d.uvarint()
+	context := d.bytes()
+	outLen := d.uvarint()
+	policy := d.byte()
+	nameLen := d.uvarint()
+	depth := d.uvarint()
+	var (
+		params *Argon2Params
+		salt   []byte
+	)
+	switch d.byte() {
+	case 0: // the root key isn't a passphrase
+	case 1:
+		time, memory := d.uvarint(), d.uvarint()
+		params = &Argon2Params{Time: uint32(time), Memory: uint32(memory), Threads: d.byte()}
+		salt = append([]byte(nil), d.bytes()...)
+		if time > math.MaxUint32 || memory > math.MaxUint32 {
+			return errInvalidEncoding
+		}
+	default:
+		return errInvalidEncoding
+	}
+	if d.err != nil || len(d.data) != 0 || iterations > math.MaxInt32 ||
+		outLen > math.MaxInt32 || nameLen > math.MaxInt32 {
+		return errInvalidEncoding
+	}
+
+	alg, err := lookupHash(string(name))
+	if err != nil {
+		return err
+	}
+
+	u := &KeyedHashTree{
+		alg:        alg,
+		blockSize:  blockSize,
+		maxSize:    maxSize,
+		factor:     factor,
+		stretch:    int(iterations),
+		outLen:     int(outLen),
+		policy:     TruncatePolicy(policy),
+		nameLen:    int(nameLen),
+		depth:      depth,
+		fixedDepth: true, // init clears this if the depth is the computed one
+	}
+	if len(context) > 0 {
+		u.context = append([]byte(nil), context...)
+	}
+	if params != nil {
+		u.argon2, u.salt = params, salt
+	}
+
+	if err := u.init(); err != nil {
+		return err
+	}
+
+	t.copyFrom(u)
+	return nil
+}
+
+func appendBytes(b, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// decoder reads values from a tree encoding, recording the first error.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errInvalidEncoding
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) < 1 {
+		d.err = errInvalidEncoding
+		return 0
+	}
+	v := d.data[0]
+	d.data = d.data[1:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.data)) {
+		d.err = errInvalidEncoding
+		return nil
+	}
+	v := d.data[:n]
+	d.data = d.data[n:]
+	return v
+}
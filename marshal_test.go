@@ -0,0 +1,151 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestMarshalBinary(t *testing.T) {
+	key := []byte("a secret root key")
+	tree := mustNew(t, key, kht.HMAC(sha256.New), 1024, 1<<30, 1024,
+		kht.WithContext([]byte("data")),
+		kht.WithRootStretch(10),
+		kht.WithOutputLength(16, kht.Trailing))
+
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(data, key) {
+		t.Error("Encoded tree contains the root key")
+	}
+
+	var decoded kht.KeyedHashTree
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := decoded.KeyAt(0); err != kht.ErrNoKey {
+		t.Errorf("Error was %v, but expected ErrNoKey", err)
+	}
+
+	if err := decoded.SetKey(key); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range []uint64{0, 1 << 20, 1<<30 - 1} {
+		if v, want := decoded.Key(offset), tree.Key(offset); !bytes.Equal(v, want) {
+			t.Errorf("Key %d was %#v, but expected %#v", offset, v, want)
+		}
+	}
+}
+
+func TestMarshalBinaryUnregistered(t *testing.T) {
+	alg := func(key []byte) hash.Hash {
+		return kht.HMAC(md5.New)(append([]byte("custom"), key...))
+	}
+	tree := mustNew(t, []byte("yay"), alg, 2, 16, 8)
+
+	if _, err := tree.MarshalBinary(); err == nil {
+		t.Fatal("No error, but expected one")
+	}
+
+	kht.RegisterKeyedHash("custom", alg)
+
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded kht.KeyedHashTree
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := decoded.SetKey([]byte("yay")); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := decoded.Key(0), tree.Key(0); !bytes.Equal(v, want) {
+		t.Errorf("Key was %#v, but expected %#v", v, want)
+	}
+}
+
+func TestUnmarshalBinaryInvalid(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8)
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range data {
+		var decoded kht.KeyedHashTree
+		if err := decoded.UnmarshalBinary(data[:i]); err == nil {
+			t.Errorf("No error for %d bytes, but expected one", i)
+		}
+	}
+}
+
+func TestUnmarshalBinaryPolicy(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8, kht.WithOutputLength(10, kht.Trailing))
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The encoding ends with the policy, the name length, the depth, and the
+	// passphrase hardening, the last three of which are a single byte each here.
+	i := len(data) - 4
+	if data[i] != byte(kht.Trailing) {
+		t.Fatalf("Policy was encoded as %d, but expected %d", data[i], kht.Trailing)
+	}
+
+	tampered := bytes.Clone(data)
+	tampered[i] = 0xff
+
+	var decoded kht.KeyedHashTree
+	if err := decoded.UnmarshalBinary(tampered); err == nil {
+		t.Error("Decoded a tree with an unknown truncate policy")
+	}
+}
+
+func TestMarshalBinaryLargeFactor(t *testing.T) {
+	// The factor isn't representable as a float64.
+	tree, err := kht.NewInt([]byte("yay"), kht.HMAC(md5.New), 2, 1<<62, 1<<61+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded kht.KeyedHashTree
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := decoded.SetKey([]byte("yay")); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := decoded.Params()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := p.Factor, uint64(1<<61+1); v != want {
+		t.Errorf("Factor was %d, but expected %d", v, want)
+	}
+
+	if v, want := decoded.Key(1<<62-1), tree.Key(1<<62-1); !bytes.Equal(v, want) {
+		t.Errorf("Key was %#v, but expected %#v", v, want)
+	}
+}
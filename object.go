@@ -0,0 +1,52 @@
+package kht
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var objectTag = []byte("kht object")
+
+// DeriveTree returns a tree for the object with the given ID, with the same
+// parameters and options as t but an independent root key, so that a single
+// master key can fan out to a tree for each of many objects without storing a
+// root key for each. The object's root key is H(root, "kht object" ||
+// len(objectID) || objectID), where root is t's root key (after any stretching
+// and context) and len(objectID) is a little-endian uint64. Every such message
+// is longer than the 16-byte messages used to derive nodes, so an object's root
+// key is never the key of a node in t, and without t's root key, the trees of
+// different objects are unrelated.
+//
+// DeriveTree returns ErrNoKey if t has no root key, and an error if t is a
+// subtree.
+func (t *KeyedHashTree) DeriveTree(objectID []byte) (*KeyedHashTree, error) {
+	if t.root == nil {
+		return nil, ErrNoKey
+	}
+
+	if t.top != 0 {
+		return nil, errors.New("kht: can't derive trees from a subtree")
+	}
+
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(objectID)))
+
+	h := t.alg(t.root)
+	defer wipeHash(h)
+
+	_, _ = h.Write(objectTag)
+	_, _ = h.Write(n[:])
+	_, _ = h.Write(objectID)
+
+	o := new(KeyedHashTree)
+	o.copyFrom(t)
+	Wipe(o.root)
+	o.root = h.Sum(nil)
+	o.stretch = 0   // the stretched root is already mixed into the object's root
+	o.context = nil // as is the context
+	o.argon2, o.salt = nil, nil
+	if err := o.precompute(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
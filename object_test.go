@@ -0,0 +1,80 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestDeriveTree(t *testing.T) {
+	master := mustNew(t, []byte("master"), kht.HMAC(sha256.New), 16, 1024, 4)
+
+	a, err := master.DeriveTree([]byte("object-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := master.DeriveTree([]byte("object-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := master.DeriveTree([]byte("object-b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(a.Key(100), again.Key(100)) {
+		t.Error("Trees for the same object derived different keys")
+	}
+
+	if bytes.Equal(a.Key(100), b.Key(100)) || bytes.Equal(a.Key(100), master.Key(100)) {
+		t.Error("Trees for different objects derived the same keys")
+	}
+
+	h := hmac.New(sha256.New, []byte("master"))
+	_, _ = h.Write([]byte("kht object"))
+	_ = binary.Write(h, binary.LittleEndian, uint64(8))
+	_, _ = h.Write([]byte("object-a"))
+
+	want := mustNew(t, h.Sum(nil), kht.HMAC(sha256.New), 16, 1024, 4)
+	if v, want := a.Key(100), want.Key(100); !bytes.Equal(v, want) {
+		t.Errorf("Key was %#v, but expected %#v", v, want)
+	}
+
+	if a.CoveredSize() != master.CoveredSize() {
+		t.Errorf("Covered size was %d, but expected %d", a.CoveredSize(), master.CoveredSize())
+	}
+}
+
+func TestDeriveTreeContext(t *testing.T) {
+	master := mustNew(t, []byte("master"), kht.HMAC(sha256.New), 16, 1024, 4, kht.WithContext([]byte("a")))
+	other := mustNew(t, []byte("master"), kht.HMAC(sha256.New), 16, 1024, 4, kht.WithContext([]byte("b")))
+
+	a, err := master.DeriveTree([]byte("object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := other.DeriveTree([]byte("object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(a.Key(0), b.Key(0)) {
+		t.Error("Masters with different contexts derived the same object trees")
+	}
+
+	sub, err := master.Subtree(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sub.DeriveTree([]byte("object")); err == nil {
+		t.Error("Derived a tree from a subtree")
+	}
+}
@@ -0,0 +1,183 @@
+// Package objstore encrypts large objects client-side for object stores which
+// support ranged reads, such as S3 or GCS.
+//
+// Each block of an object is sealed with kht.SealBlock under its own derived
+// key, from a kht.Deriver such as a kht.KeyedHashTree, and stored in the same
+// layout as kht.NewWriterAt: the block containing offset x is stored at
+// (x-base)/blockSize*(blockSize+overhead), where base is the first offset of a
+// subtree (see kht.KeyedHashTree.Range), and 0 otherwise. A range of plaintext
+// therefore maps onto a range of the stored object which starts and ends on
+// block boundaries, so reading it fetches and decrypts only the blocks it
+// touches, rather than the whole object. Blocks can be sealed independently, so
+// an object can be uploaded in parts, in any order and in parallel.
+//
+// Each block is authenticated on its own, so an object whose final blocks
+// have been dropped reads as a shorter object, without error. Where that
+// matters, the object's length should be authenticated elsewhere, or its
+// blocks tracked with a kht.IntegrityTree.
+package objstore
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/codahale/kht"
+)
+
+// A Backend is an object store which supports ranged reads and multipart
+// uploads.
+type Backend interface {
+	// GetRange returns up to length bytes of the named object, starting at the
+	// given offset, as with an HTTP range request. It returns fewer bytes if
+	// the object ends before the range does, and none if it ends before the
+	// range starts.
+	GetRange(ctx context.Context, name string, offset, length int64) ([]byte, error)
+
+	// PutPart stores data as the part of the named object which starts at the
+	// given offset. Parts never overlap, and every part but the last ends on a
+	// block boundary.
+	PutPart(ctx context.Context, name string, offset int64, data []byte) error
+}
+
+// An Object is an encrypted object in a Backend.
+type Object struct {
+	backend   Backend
+	name      string
+	keys      kht.Deriver
+	aead      kht.AEAD
+	base, end uint64
+	overhead  uint64
+}
+
+// NewObject returns the named object in the given backend, whose blocks are
+// sealed with ciphers from aead keyed with the keys from d. It returns an error
+// if d can't derive a key (e.g., a tree has no root key) or if aead returns
+// one.
+func NewObject(b Backend, name string, d kht.Deriver, aead kht.AEAD) (*Object, error) {
+	base, end := uint64(0), d.MaxSize()
+	if t, ok := d.(*kht.KeyedHashTree); ok {
+		base, end = t.Range()
+	}
+
+	k, err := d.KeyAt(base)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := aead(k)
+	kht.Wipe(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Object{
+		backend:  b,
+		name:     name,
+		keys:     d,
+		aead:     aead,
+		base:     base,
+		end:      end,
+		overhead: uint64(c.NonceSize() + c.Overhead()),
+	}, nil
+}
+
+// StoredRange returns the range of the stored object which holds the blocks
+// containing the plaintext bytes in [start, start+length), as an offset and a
+// length, for making range requests directly. The range must be within the
+// range of the object's keys: a tree's range (see kht.KeyedHashTree.Range),
+// or up to any other kht.Deriver's MaxSize.
+func (o *Object) StoredRange(start, length uint64) (offset, n int64) {
+	if length == 0 {
+		return o.position(start), 0
+	}
+
+	bs := o.keys.BlockSize()
+	first, last := (start-o.base)/bs, (start-o.base+length-1)/bs
+	return o.position(start), int64((last - first + 1) * (bs + o.overhead))
+}
+
+// position returns the position of the sealed block containing the given
+// offset.
+func (o *Object) position(offset uint64) int64 {
+	bs := o.keys.BlockSize()
+	return int64((offset - o.base) / bs * (bs + o.overhead))
+}
+
+// GetRange returns length bytes of the object's plaintext, starting at the
+// given offset, fetching and decrypting only the blocks which contain them. If
+// the object ends before the range does, GetRange returns the bytes up to its
+// end; if it ends before the range starts, it returns io.EOF. It returns an
+// error if any of the blocks aren't authentic.
+func (o *Object) GetRange(ctx context.Context, start, length uint64) ([]byte, error) {
+	if length == 0 {
+		return nil, nil
+	}
+
+	if start < o.base {
+		return nil, &kht.OffsetError{Offset: start, Base: o.base, MaxSize: o.end}
+	}
+
+	if start+length < start || start+length > o.end {
+		return nil, &kht.OffsetError{Offset: start + length - 1, Base: o.base, MaxSize: o.end}
+	}
+
+	offset, n := o.StoredRange(start, length)
+	sealed, err := o.backend.GetRange(ctx, o.name, offset, n)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := o.keys.BlockSize()
+	plaintext := make([]byte, 0, length+start%bs)
+	for block := start - start%bs; len(sealed) > 0; block += bs {
+		b := sealed[:min(uint64(len(sealed)), bs+o.overhead)]
+		sealed = sealed[len(b):]
+
+		plaintext, err = kht.OpenBlock(o.keys, o.aead, block, b, plaintext)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	skip := start % bs
+	if uint64(len(plaintext)) <= skip {
+		return nil, io.EOF
+	}
+	return plaintext[skip:min(uint64(len(plaintext)), skip+length)], nil
+}
+
+var errUnaligned = errors.New("objstore: parts must start on a block boundary")
+
+// PutBlocks seals the given plaintext as the blocks starting with the one at
+// the given offset, which must be a block boundary, and stores them as a part
+// of the object. Parts can be uploaded in any order, or in parallel; every part
+// but the last must hold a whole number of blocks. Each block is sealed with a
+// random nonce (see kht.SealBlock), so parts can be uploaded again without
+// reusing a nonce.
+func (o *Object) PutBlocks(ctx context.Context, start uint64, plaintext []byte) error {
+	bs := o.keys.BlockSize()
+	if start%bs != 0 {
+		return errUnaligned
+	}
+
+	if len(plaintext) == 0 {
+		return nil
+	}
+
+	sealed := make([]byte, 0, o.sealedLen(uint64(len(plaintext))))
+	for i := uint64(0); i < uint64(len(plaintext)); i += bs {
+		var err error
+		sealed, err = kht.SealBlock(o.keys, o.aead, start+i, plaintext[i:min(i+bs, uint64(len(plaintext)))], sealed)
+		if err != nil {
+			return err
+		}
+	}
+	return o.backend.PutPart(ctx, o.name, o.position(start), sealed)
+}
+
+// sealedLen returns the number of bytes n bytes of plaintext take once sealed.
+func (o *Object) sealedLen(n uint64) uint64 {
+	bs := o.keys.BlockSize()
+	return n + (n+bs-1)/bs*o.overhead
+}
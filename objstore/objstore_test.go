@@ -0,0 +1,244 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/codahale/kht"
+	"github.com/codahale/kht/objstore"
+)
+
+// memBackend is an in-memory Backend which records the ranges requested.
+type memBackend struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	fetched int64
+}
+
+func (b *memBackend) GetRange(_ context.Context, name string, offset, length int64) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj := b.objects[name]
+	if offset >= int64(len(obj)) {
+		return nil, nil
+	}
+
+	data := obj[offset:min(offset+length, int64(len(obj)))]
+	b.fetched += int64(len(data))
+	return bytes.Clone(data), nil
+}
+
+func (b *memBackend) PutPart(_ context.Context, name string, offset int64, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj := b.objects[name]
+	if end := int(offset) + len(data); end > len(obj) {
+		obj = append(obj, make([]byte, end-len(obj))...)
+	}
+	copy(obj[offset:], data)
+	b.objects[name] = obj
+	return nil
+}
+
+func (b *memBackend) ReadAt(p []byte, off int64) (int, error) {
+	obj := b.objects["obj"]
+	if off >= int64(len(obj)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, obj[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func upload(t *testing.T, d kht.Deriver, base uint64, plaintext []byte) (*memBackend, *objstore.Object) {
+	t.Helper()
+
+	backend := &memBackend{objects: make(map[string][]byte)}
+	obj, err := objstore.NewObject(backend, "obj", d, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Upload 48-byte parts in parallel.
+	var wg sync.WaitGroup
+	errs := make(chan error, len(plaintext)/48+1)
+	for i := 0; i < len(plaintext); i += 48 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- obj.PutBlocks(context.Background(), base+uint64(i), plaintext[i:min(i+48, len(plaintext))])
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return backend, obj
+}
+
+func TestObject(t *testing.T) {
+	tree, err := kht.New([]byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := bytes.Repeat([]byte("abcdefghij"), 20)
+	backend, obj := upload(t, tree, 0, plaintext)
+
+	for _, r := range [][2]uint64{{0, 200}, {3, 20}, {16, 16}, {150, 49}, {190, 100}} {
+		backend.fetched = 0
+		got, err := obj.GetRange(context.Background(), r[0], r[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := plaintext[r[0]:min(r[0]+r[1], 200)]; !bytes.Equal(got, want) {
+			t.Errorf("Range %v was %q, but expected %q", r, got, want)
+		}
+
+		if _, n := obj.StoredRange(r[0], r[1]); backend.fetched > n {
+			t.Errorf("Range %v fetched %d bytes, but expected at most %d", r, backend.fetched, n)
+		}
+	}
+
+	if _, err := obj.GetRange(context.Background(), 200, 10); err != io.EOF {
+		t.Errorf("Error past the end was %v, but expected io.EOF", err)
+	}
+
+	// The stored object is readable with NewReaderAt.
+	r, err := kht.NewReaderAt(backend, tree, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(plaintext))
+	if _, err := r.ReadAt(got, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Plaintext was %q, but expected %q", got, plaintext)
+	}
+}
+
+func TestObjectCounterKDF(t *testing.T) {
+	kdf, err := kht.NewCounterKDF([]byte("yay"), kht.HMAC(sha256.New), 16, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := bytes.Repeat([]byte("abcdefghij"), 20)
+	backend, obj := upload(t, kdf, 0, plaintext)
+
+	got, err := obj.GetRange(context.Background(), 37, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := plaintext[37:137]; !bytes.Equal(got, want) {
+		t.Errorf("Range was %q, but expected %q", got, want)
+	}
+
+	if _, err := obj.GetRange(context.Background(), 990, 20); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+
+	// The stored object is readable with NewReaderAt and the KDF.
+	r, err := kht.NewReaderAt(backend, kdf, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = make([]byte, len(plaintext))
+	if _, err := r.ReadAt(got, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Plaintext was %q, but expected %q", got, plaintext)
+	}
+}
+
+func TestObjectSubtree(t *testing.T) {
+	tree, err := kht.New([]byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := tree.Subtree(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := bytes.Repeat([]byte("abcdefghij"), 20)
+	backend, obj := upload(t, sub, 512, plaintext)
+
+	if offset, _ := obj.StoredRange(512, 10); offset != 0 {
+		t.Errorf("Subtree's first block was stored at %d, but expected 0", offset)
+	}
+
+	got, err := obj.GetRange(context.Background(), 530, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := plaintext[18:118]; !bytes.Equal(got, want) {
+		t.Errorf("Range was %q, but expected %q", got, want)
+	}
+
+	// The stored object is readable with NewReaderAt and the subtree.
+	r, err := kht.NewReaderAt(backend, sub, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = make([]byte, len(plaintext))
+	if _, err := r.ReadAt(got, 512); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Plaintext was %q, but expected %q", got, plaintext)
+	}
+
+	if _, err := obj.GetRange(context.Background(), 500, 20); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error before the subtree was %v, but expected ErrOffsetOutOfRange", err)
+	}
+}
+
+func TestObjectInvalid(t *testing.T) {
+	tree, err := kht.New([]byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := bytes.Repeat([]byte("abcdefghij"), 20)
+	backend, obj := upload(t, tree, 0, plaintext)
+
+	if err := obj.PutBlocks(context.Background(), 8, []byte("boo")); err == nil {
+		t.Error("Stored an unaligned part")
+	}
+
+	backend.objects["obj"][50] ^= 1
+	if _, err := obj.GetRange(context.Background(), 30, 4); err == nil {
+		t.Error("Decrypted a modified block")
+	}
+
+	if _, err := obj.GetRange(context.Background(), 1000, 100); err == nil {
+		t.Error("Read past the end of the tree")
+	}
+}
@@ -0,0 +1,57 @@
+package kht
+
+import "time"
+
+// An Observer is told about the work a tree does deriving keys, so it can be
+// reported to a metrics or tracing system (e.g., Prometheus or OpenTelemetry)
+// without this package depending on one. Observers are called synchronously,
+// by whichever goroutine did the work, so they must be safe for concurrent use
+// and should return quickly.
+type Observer interface {
+	// Derived is called after each derivation.
+	Derived(d Derivation)
+}
+
+// WithObserver returns an Option which reports every derivation the tree
+// performs to the given Observer. Measuring derivations costs two calls to
+// time.Now each, so it's disabled by default.
+func WithObserver(o Observer) Option {
+	return func(t *KeyedHashTree) {
+		t.observer = o
+	}
+}
+
+// A CacheResult is the use a derivation made of the tree's node cache.
+type CacheResult int
+
+const (
+	// CacheDisabled means the derivation didn't consult the node cache, either
+	// because the tree has none or because it derived keys with a cursor or a
+	// batch (see Keys).
+	CacheDisabled CacheResult = iota
+
+	// CacheHit means the derivation started from a cached node.
+	CacheHit
+
+	// CacheMiss means the derivation consulted the cache but started from the
+	// root.
+	CacheMiss
+)
+
+// A Derivation describes the derivation of one or more consecutive nodes at
+// the same level of a tree, which for the keys of blocks is the tree's depth.
+type Derivation struct {
+	Offset   uint64        // the first offset covered by the derived nodes
+	Level    uint64        // the level of the derived nodes
+	Nodes    uint64        // the number of nodes derived
+	Hashes   uint64        // the number of keyed hash invocations
+	Cache    CacheResult   // the use made of the node cache
+	Duration time.Duration // the time taken
+}
+
+// observe reports a derivation which started at the given time, if the tree
+// has an observer.
+func (t *KeyedHashTree) observe(d Derivation, start time.Time) {
+	d.Duration = time.Since(start)
+	t.observer.Derived(d)
+}
@@ -0,0 +1,109 @@
+package kht_test
+
+import (
+	"crypto/md5"
+	"sync"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+type recorder struct {
+	mu          sync.Mutex
+	derivations []kht.Derivation
+}
+
+func (r *recorder) Derived(d kht.Derivation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.derivations = append(r.derivations, d)
+}
+
+func (r *recorder) reset() []kht.Derivation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d := r.derivations
+	r.derivations = nil
+	return d
+}
+
+func TestObserver(t *testing.T) {
+	r := new(recorder)
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 128, 4, kht.WithObserver(r))
+
+	_ = tree.Key(100)
+	if _, err := tree.NodeKey(2, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	d := r.reset()
+	if len(d) != 2 {
+		t.Fatalf("Observed %d derivations, but expected 2", len(d))
+	}
+
+	want := []kht.Derivation{
+		{Offset: 100, Level: 3, Nodes: 1, Hashes: 3},
+		{Offset: 5 * 8, Level: 2, Nodes: 1, Hashes: 2},
+	}
+	for i := range d {
+		if d[i].Duration < 0 {
+			t.Errorf("Derivation %d had a duration of %v", i, d[i].Duration)
+		}
+
+		d[i].Duration = 0
+		if d[i] != want[i] {
+			t.Errorf("Derivation %d was %+v, but expected %+v", i, d[i], want[i])
+		}
+	}
+
+	// A cursor only rederives the nodes which change between blocks.
+	_ = tree.Keys(0, 5)
+	var hashes uint64
+	for _, d := range r.reset() {
+		hashes += d.Hashes
+	}
+
+	if want := uint64(3 + 4 + 1); hashes != want {
+		t.Errorf("Keys took %d hashes, but expected %d", hashes, want)
+	}
+}
+
+func TestObserverCache(t *testing.T) {
+	r := new(recorder)
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 128, 4, kht.WithObserver(r), kht.WithNodeCache(16))
+
+	_ = tree.Key(0)
+	_ = tree.Key(2)
+
+	d := r.reset()
+	if v, want := []kht.CacheResult{d[0].Cache, d[1].Cache}, []kht.CacheResult{kht.CacheMiss, kht.CacheHit}; v[0] != want[0] || v[1] != want[1] {
+		t.Errorf("Cache results were %v, but expected %v", v, want)
+	}
+
+	if v, want := d[1].Hashes, uint64(1); v != want {
+		t.Errorf("Cached derivation took %d hashes, but expected %d", v, want)
+	}
+}
+
+func TestObserverBatch(t *testing.T) {
+	r := new(recorder)
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 128, 4,
+		kht.WithObserver(r), kht.WithBatchHash(kht.ParallelBatch(kht.HMAC(md5.New))))
+
+	_ = tree.Keys(0, 64)
+
+	d := r.reset()
+	if len(d) != 1 {
+		t.Fatalf("Observed %d derivations, but expected 1", len(d))
+	}
+
+	if v, want := d[0].Hashes, uint64(4+16+64); v != want {
+		t.Errorf("Batch took %d hashes, but expected %d", v, want)
+	}
+
+	if v, want := d[0].Nodes, uint64(64); v != want {
+		t.Errorf("Batch derived %d nodes, but expected %d", v, want)
+	}
+}
@@ -0,0 +1,89 @@
+package kht
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// KeysParallel derives the keys of the blocks containing the bytes in [start,
+// end) using GOMAXPROCS goroutines, calling fn with each block's offset and
+// derived key. The range is partitioned into subtrees, and each goroutine
+// derives the keys of a subtree at a time with its own cursor, reusing the
+// ancestor nodes shared between adjacent blocks, so the tree remains safe for
+// concurrent use.
+//
+// fn is called concurrently and in no particular order, and it owns the keys
+// passed to it. If fn returns an error, KeysParallel stops deriving keys and
+// returns the first error returned. It returns an *OffsetError if the range
+// isn't within the tree, and ErrNoKey if the tree has no root key.
+func (t *KeyedHashTree) KeysParallel(start, end uint64, fn func(offset uint64, key []byte) error) error {
+	if t.root == nil {
+		return ErrNoKey
+	}
+
+	if start >= end {
+		return nil
+	}
+
+	if err := t.checkOffset(start); err != nil {
+		return err
+	}
+
+	if err := t.checkOffset(end - 1); err != nil {
+		return err
+	}
+
+	start -= start % t.blockSize
+	workers := runtime.GOMAXPROCS(0)
+	chunk := t.chunkSize(end-start, uint64(workers)*4)
+	first, last := start/chunk, (end-1)/chunk
+
+	var (
+		next    atomic.Uint64
+		stopped atomic.Bool
+		once    sync.Once
+		wg      sync.WaitGroup
+		err     error
+	)
+	next.Store(first)
+
+	for range min(uint64(workers), last-first+1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := newCursor(t)
+			defer c.wipe()
+
+			for i := next.Add(1) - 1; i <= last && !stopped.Load(); i = next.Add(1) - 1 {
+				lo, hi := max(i*chunk, start), i*chunk+min(chunk-1, end-1-i*chunk)
+				for offset := lo; offset <= hi && !stopped.Load(); offset += t.blockSize {
+					if e := fn(offset, c.key(offset)); e != nil {
+						once.Do(func() { err = e })
+						stopped.Store(true)
+					}
+
+					if hi-offset < t.blockSize {
+						break // the next offset might overflow
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return err
+}
+
+// chunkSize returns the size of the largest nodes in the tree which split a
+// range of the given length into at least n pieces, or the block size if there
+// are none.
+func (t *KeyedHashTree) chunkSize(length, n uint64) uint64 {
+	for level := t.top + 1; level <= t.depth; level++ {
+		if length/t.sizes[level] >= n {
+			return t.sizes[level]
+		}
+	}
+	return t.blockSize
+}
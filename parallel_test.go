@@ -0,0 +1,108 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestKeysParallel(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1<<20, 4)
+
+	var mu sync.Mutex
+	keys := make(map[uint64][]byte)
+	if err := tree.KeysParallel(100, 50000, func(offset uint64, key []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if _, ok := keys[offset]; ok {
+			t.Errorf("Derived %d more than once", offset)
+		}
+		keys[offset] = key
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := tree.Keys(96, (50000-1)/16-96/16+1)
+	if len(keys) != len(want) {
+		t.Fatalf("Derived %d keys, but expected %d", len(keys), len(want))
+	}
+
+	for i, k := range want {
+		offset := 96 + uint64(i)*16
+		if !bytes.Equal(keys[offset], k) {
+			t.Errorf("Key %d was %#v, but expected %#v", offset, keys[offset], k)
+		}
+	}
+}
+
+func TestKeysParallelSaturated(t *testing.T) {
+	// The tree covers every offset, and its last block is a single byte.
+	tree, err := kht.NewWithDepth([]byte("yay"), kht.HMAC(sha256.New), 7, 1000, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	keys := make(map[uint64][]byte)
+	if err := tree.KeysParallel(math.MaxUint64-10, math.MaxUint64, func(offset uint64, key []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		keys[offset] = key
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 3 {
+		t.Errorf("Derived %d keys, but expected 3", len(keys))
+	}
+
+	for _, offset := range []uint64{math.MaxUint64 - 15, math.MaxUint64 - 8, math.MaxUint64 - 1} {
+		if want := tree.Key(offset); !bytes.Equal(keys[offset], want) {
+			t.Errorf("Key %d was %#v, but expected %#v", offset, keys[offset], want)
+		}
+	}
+}
+
+func TestKeysParallelError(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1<<20, 4)
+	stop := errors.New("stop")
+
+	var n atomic.Int64
+	err := tree.KeysParallel(0, 1<<20, func(offset uint64, key []byte) error {
+		if n.Add(1) == 10 {
+			return stop
+		}
+		return nil
+	})
+
+	if err != stop {
+		t.Errorf("Error was %v, but expected %v", err, stop)
+	}
+
+	if v := n.Load(); v >= 1<<16 {
+		t.Errorf("Derived %d keys after an error", v)
+	}
+
+	if err := tree.KeysParallel(0, 1<<20+1, nil); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+}
+
+func BenchmarkKeysParallel(b *testing.B) {
+	tree := mustNew(b, []byte("yay"), kht.HMAC(sha256.New), 1024, 1<<30, 1024)
+	b.SetBytes(1 << 24)
+
+	for b.Loop() {
+		_ = tree.KeysParallel(0, 1<<24, func(uint64, []byte) error { return nil })
+	}
+}
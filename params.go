@@ -0,0 +1,197 @@
+package kht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Params are the parameters of a tree: everything needed to rebuild it, other
+// than its root key. They can be stored alongside the data the tree's keys
+// encrypt, either as JSON or in the binary form produced by MarshalBinary.
+type Params struct {
+	Hash       string         `json:"hash"` // the registered name of the keyed hash
+	BlockSize  uint64         `json:"blockSize"`
+	MaxSize    uint64         `json:"maxSize"`
+	Factor     uint64         `json:"factor"`
+	Depth      uint64         `json:"depth,omitempty"` // if nonzero, the tree's fixed depth (see Grow)
+	KeyLength  int            `json:"keyLength,omitempty"`
+	Policy     TruncatePolicy `json:"policy,omitempty"`
+	Stretch    int            `json:"stretch,omitempty"`
+	Context    []byte         `json:"context,omitempty"`
+	NameLength int            `json:"nameLength,omitempty"`
+	Argon2     *Argon2Params  `json:"argon2,omitempty"` // if set, the root key is a passphrase
+	Salt       []byte         `json:"salt,omitempty"`   // the Argon2 salt
+}
+
+// Params returns the tree's parameters. It returns an error if the tree is a
+// subtree, or if its keyed hash isn't registered (see RegisterKeyedHash).
+func (t *KeyedHashTree) Params() (Params, error) {
+	if t.top != 0 {
+		return Params{}, errors.New("kht: a subtree has no parameters")
+	}
+
+	name, err := hashName(t.alg)
+	if err != nil {
+		return Params{}, err
+	}
+
+	p := Params{
+		Hash:       name,
+		BlockSize:  t.blockSize,
+		MaxSize:    t.maxSize,
+		Factor:     t.factor,
+		KeyLength:  max(t.outLen, 0),
+		Policy:     t.policy,
+		Stretch:    max(t.stretch, 0),
+		Context:    bytes.Clone(t.context),
+		NameLength: t.nameLen,
+	}
+	if t.fixedDepth {
+		p.Depth = t.depth
+	}
+	if t.argon2 != nil {
+		a := *t.argon2
+		p.Argon2 = &a
+		p.Salt = bytes.Clone(t.salt)
+	}
+	return p, nil
+}
+
+// FromParams returns a tree with the given root key and parameters, which
+// derives the same keys as the tree the parameters were taken from. Like
+// UnmarshalBinary, it returns an error before hardening the key if the
+// parameters' root stretch or Argon2 costs are greater than their maximums.
+func FromParams(key []byte, p Params) (*KeyedHashTree, error) {
+	if len(key) == 0 {
+		return nil, errors.New("kht: key must not be empty")
+	}
+
+	t, err := p.tree()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.SetKey(key); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// tree returns a tree with the parameters and no root key.
+func (p Params) tree() (*KeyedHashTree, error) {
+	alg, err := lookupHash(p.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &KeyedHashTree{
+		alg:        alg,
+		blockSize:  p.BlockSize,
+		maxSize:    p.MaxSize,
+		factor:     p.Factor,
+		depth:      p.Depth,
+		fixedDepth: p.Depth != 0,
+		outLen:     p.KeyLength,
+		policy:     p.Policy,
+		stretch:    p.Stretch,
+		nameLen:    p.NameLength,
+	}
+	if t.nameLen == 0 {
+		t.nameLen = 16
+	}
+	if len(p.Context) > 0 {
+		t.context = append([]byte(nil), p.Context...)
+	}
+	if p.Argon2 != nil {
+		withArgon2(p.Salt, *p.Argon2)(t)
+	}
+
+	if err := t.init(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// paramsMagic begins every binary encoding of Params.
+var paramsMagic = []byte("KHT\x00")
+
+// MarshalBinary encodes the parameters with a header suitable for the front of
+// an encrypted file: the magic bytes "KHT\x00", the length of the rest of the
+// encoding as a uvarint, and the tree's encoding (see
+// KeyedHashTree.MarshalBinary), which begins with a version byte.
+func (p Params) MarshalBinary() ([]byte, error) {
+	t, err := p.tree()
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := t.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	b := append([]byte(nil), paramsMagic...)
+	b = binary.AppendUvarint(b, uint64(len(enc)))
+	return append(b, enc...), nil
+}
+
+// UnmarshalBinary decodes parameters encoded by MarshalBinary.
+func (p *Params) UnmarshalBinary(data []byte) error {
+	q, err := ReadParams(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	*p = q
+	return nil
+}
+
+var errNotParams = errors.New("kht: not an encoding of tree parameters")
+
+// ReadParams reads parameters encoded by MarshalBinary from the front of r,
+// consuming exactly the bytes of the encoding, so the rest of r can be read
+// afterwards.
+func ReadParams(r io.Reader) (Params, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return Params{}, errNotParams
+	}
+
+	if !bytes.Equal(magic[:], paramsMagic) {
+		return Params{}, errNotParams
+	}
+
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &byteReader{r: r}
+	}
+
+	n, err := binary.ReadUvarint(br)
+	if err != nil || n > 1<<16 {
+		return Params{}, errInvalidEncoding
+	}
+
+	enc := make([]byte, n)
+	if _, err := io.ReadFull(r, enc); err != nil {
+		return Params{}, errInvalidEncoding
+	}
+
+	var t KeyedHashTree
+	if err := t.UnmarshalBinary(enc); err != nil {
+		return Params{}, err
+	}
+	return t.Params()
+}
+
+// byteReader reads single bytes from a reader without buffering, unlike
+// bufio.Reader, so no bytes past the encoding are consumed.
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(b.r, b.buf[:])
+	return b.buf[0], err
+}
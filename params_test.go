@@ -0,0 +1,172 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestParams(t *testing.T) {
+	key := []byte("a secret root key")
+	tree := mustNew(t, key, kht.HMAC(sha256.New), 1024, 1<<30, 1024,
+		kht.WithContext([]byte("data")),
+		kht.WithKeyLength(64))
+
+	p, err := tree.Params()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := kht.Params{
+		Hash:       "HMAC-SHA256",
+		BlockSize:  1024,
+		MaxSize:    1 << 30,
+		Factor:     1024,
+		KeyLength:  64,
+		Context:    []byte("data"),
+		NameLength: 16,
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("Params were %+v, but expected %+v", p, want)
+	}
+
+	data, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(data, []byte("KHT\x00")) {
+		t.Errorf("Encoding %x doesn't start with the magic bytes", data)
+	}
+
+	var decoded kht.Params
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, p) {
+		t.Errorf("Decoded params were %+v, but expected %+v", decoded, p)
+	}
+
+	rebuilt, err := kht.FromParams(key, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := rebuilt.Key(12345), tree.Key(12345); !bytes.Equal(v, want) {
+		t.Errorf("Key was %#v, but expected %#v", v, want)
+	}
+}
+
+func TestParamsCopied(t *testing.T) {
+	label := []byte("data")
+	tree, err := kht.NewFromPassphrase([]byte("yay"), []byte("0123456789abcdef"), cheapArgon2,
+		kht.HMAC(sha256.New), 16, 1024, 4, kht.WithContext(label))
+	if err != nil {
+		t.Fatal(err)
+	}
+	label[0] = 'x'
+
+	p, err := tree.Params()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := p.Context, []byte("data"); !bytes.Equal(v, want) {
+		t.Errorf("Context was %q, but expected %q", v, want)
+	}
+	p.Context[0] = 'x'
+	p.Salt[0] = 'x'
+
+	q, err := tree.Params()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := q.Context, []byte("data"); !bytes.Equal(v, want) {
+		t.Errorf("Context was %q, but expected %q", v, want)
+	}
+
+	if v, want := q.Salt, []byte("0123456789abcdef"); !bytes.Equal(v, want) {
+		t.Errorf("Salt was %q, but expected %q", v, want)
+	}
+}
+
+func TestParamsJSON(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	grown, err := tree.Grow(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := grown.Params()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded kht.Params
+	if err := json.Unmarshal(j, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt, err := kht.FromParams([]byte("yay"), decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := rebuilt.Key(4000), grown.Key(4000); !bytes.Equal(v, want) {
+		t.Errorf("Key was %#v, but expected %#v", v, want)
+	}
+}
+
+func TestReadParams(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	p, err := tree.Params()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := io.MultiReader(bytes.NewReader(header), bytes.NewReader([]byte("ciphertext")))
+	decoded, err := kht.ReadParams(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, p) {
+		t.Errorf("Decoded params were %+v, but expected %+v", decoded, p)
+	}
+
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(rest) != "ciphertext" {
+		t.Errorf("Rest of the file was %q, but expected %q", rest, "ciphertext")
+	}
+
+	for i := range header {
+		if _, err := kht.ReadParams(bytes.NewReader(header[:i])); err == nil {
+			t.Errorf("No error for %d bytes, but expected one", i)
+		}
+	}
+
+	if _, err := kht.ReadParams(bytes.NewReader([]byte("not a header"))); err == nil {
+		t.Error("No error for a bad header, but expected one")
+	}
+}
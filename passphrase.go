@@ -0,0 +1,93 @@
+package kht
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Params are the cost parameters of Argon2id (RFC 9106), used to harden
+// passphrases into root keys (see NewFromPassphrase).
+type Argon2Params struct {
+	Time    uint32 `json:"time"`    // the number of passes over the memory
+	Memory  uint32 `json:"memory"`  // the memory used, in KiB
+	Threads uint8  `json:"threads"` // the degree of parallelism
+}
+
+// DefaultArgon2Params are the second recommended option of RFC 9106: three
+// passes over 64 MiB of memory with four lanes.
+var DefaultArgon2Params = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// argon2KeyLength is the length of the root keys which Argon2id produces.
+const argon2KeyLength = 32
+
+// minSaltLength is the shortest salt Argon2 accepts.
+const minSaltLength = 8
+
+// The largest Argon2 cost parameters a tree accepts, which bound the work done
+// to rebuild a tree from untrusted parameters (e.g., a file's header) before
+// anything can be authenticated. The memory is that of the first recommended
+// option of RFC 9106.
+const (
+	MaxArgon2Time   = 16
+	MaxArgon2Memory = 2 * 1024 * 1024 // 2 GiB, in KiB
+)
+
+// NewFromPassphrase returns a KeyedHashTree whose root key is hardened from
+// the given passphrase with Argon2id, using the given salt and cost
+// parameters, before the key enters the tree. Otherwise it's the same as New.
+// The salt should be 16 random bytes, unique to each passphrase and object,
+// and needn't be secret.
+//
+// The salt and cost parameters are part of the tree's parameters (see Params
+// and MarshalBinary), so the tree can be rebuilt from the passphrase alone with
+// FromParams or SetKey. The 32-byte Argon2id output replaces the passphrase as
+// the root key, followed by any stretching and context label, and the
+// passphrase itself is never used as a key. NewFromPassphrase returns an error
+// if the salt is shorter than 8 bytes, the time or thread count is zero, the
+// memory is less than 8 KiB per thread, or the time or memory is greater than
+// MaxArgon2Time or MaxArgon2Memory, as well as for any of the reasons New
+// does.
+func NewFromPassphrase(passphrase, salt []byte, params Argon2Params, alg KeyedHash, blockSize, maxSize uint64, factor float64, opts ...Option) (*KeyedHashTree, error) {
+	opts = append(opts[:len(opts):len(opts)], withArgon2(salt, params))
+	return New(passphrase, alg, blockSize, maxSize, factor, opts...)
+}
+
+// withArgon2 returns an Option which hardens the root key with Argon2id.
+func withArgon2(salt []byte, params Argon2Params) Option {
+	return func(t *KeyedHashTree) {
+		t.argon2 = &params
+		t.salt = append([]byte(nil), salt...)
+	}
+}
+
+// checkArgon2 returns an error if the tree's Argon2 parameters are invalid.
+func (t *KeyedHashTree) checkArgon2() error {
+	if t.argon2 == nil {
+		return nil
+	}
+
+	if len(t.salt) < minSaltLength {
+		return errors.New("kht: salt must be at least 8 bytes long")
+	}
+
+	p := t.argon2
+	if p.Time == 0 || p.Threads == 0 {
+		return errors.New("kht: Argon2 time and threads must be greater than zero")
+	}
+
+	if p.Memory < 8*uint32(p.Threads) {
+		return errors.New("kht: Argon2 memory must be at least 8 KiB per thread")
+	}
+
+	if p.Time > MaxArgon2Time || p.Memory > MaxArgon2Memory {
+		return errors.New("kht: Argon2 time or memory is too large")
+	}
+	return nil
+}
+
+// harden returns the Argon2id hash of the given passphrase.
+func (t *KeyedHashTree) harden(passphrase []byte) []byte {
+	p := t.argon2
+	return argon2.IDKey(passphrase, t.salt, p.Time, p.Memory, p.Threads, argon2KeyLength)
+}
@@ -0,0 +1,178 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/codahale/kht"
+	"golang.org/x/crypto/argon2"
+)
+
+var cheapArgon2 = kht.Argon2Params{Time: 1, Memory: 64, Threads: 1}
+
+func TestNewFromPassphrase(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	tree, err := kht.NewFromPassphrase([]byte("yay"), salt, cheapArgon2, kht.HMAC(sha256.New), 16, 1024, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := argon2.IDKey([]byte("yay"), salt, 1, 64, 1, 32)
+	want := mustNew(t, root, kht.HMAC(sha256.New), 16, 1024, 4)
+	if v, want := tree.Key(100), want.Key(100); !bytes.Equal(v, want) {
+		t.Errorf("Key was %#v, but expected %#v", v, want)
+	}
+
+	other, err := kht.NewFromPassphrase([]byte("yay"), []byte("fedcba9876543210"), cheapArgon2, kht.HMAC(sha256.New), 16, 1024, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(tree.Key(100), other.Key(100)) {
+		t.Error("Trees with different salts derived the same keys")
+	}
+
+	sub, err := tree.Subtree(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := sub.Key(300), tree.Key(300); !bytes.Equal(v, want) {
+		t.Errorf("Subtree key was %#v, but expected %#v", v, want)
+	}
+}
+
+func TestNewFromPassphraseRoundTrip(t *testing.T) {
+	tree, err := kht.NewFromPassphrase([]byte("yay"), []byte("0123456789abcdef"), cheapArgon2,
+		kht.HMAC(sha256.New), 16, 1024, 4, kht.WithRootStretch(10), kht.WithContext([]byte("ctx")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded kht.KeyedHashTree
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := decoded.SetKey([]byte("yay")); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := decoded.Key(100), tree.Key(100); !bytes.Equal(v, want) {
+		t.Errorf("Unmarshaled key was %#v, but expected %#v", v, want)
+	}
+
+	p, err := tree.Params()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var q kht.Params
+	if err := json.Unmarshal(j, &q); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt, err := kht.FromParams([]byte("yay"), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := rebuilt.Key(100), tree.Key(100); !bytes.Equal(v, want) {
+		t.Errorf("Rebuilt key was %#v, but expected %#v", v, want)
+	}
+
+	for i := range data {
+		var d kht.KeyedHashTree
+		if err := d.UnmarshalBinary(data[:i]); err == nil {
+			t.Errorf("No error for %d bytes, but expected one", i)
+		}
+	}
+}
+
+func TestNewFromPassphraseInvalid(t *testing.T) {
+	tests := map[string]struct {
+		salt   []byte
+		params kht.Argon2Params
+	}{
+		"short salt":    {[]byte("salt"), cheapArgon2},
+		"zero time":     {[]byte("0123456789abcdef"), kht.Argon2Params{Memory: 64, Threads: 1}},
+		"zero threads":  {[]byte("0123456789abcdef"), kht.Argon2Params{Time: 1, Memory: 64}},
+		"little memory": {[]byte("0123456789abcdef"), kht.Argon2Params{Time: 1, Memory: 15, Threads: 2}},
+		"much time":     {[]byte("0123456789abcdef"), kht.Argon2Params{Time: kht.MaxArgon2Time + 1, Memory: 64, Threads: 1}},
+		"much memory":   {[]byte("0123456789abcdef"), kht.Argon2Params{Time: 1, Memory: kht.MaxArgon2Memory + 1, Threads: 1}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := kht.NewFromPassphrase([]byte("yay"), test.salt, test.params, kht.HMAC(sha256.New), 16, 1024, 4)
+			if err == nil {
+				t.Error("Created a tree with invalid Argon2 parameters")
+			}
+		})
+	}
+}
+
+func TestUntrustedCostBounds(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	tests := map[string]kht.Params{
+		"argon2 time":   {Argon2: &kht.Argon2Params{Time: math.MaxUint32, Memory: 64, Threads: 1}, Salt: salt},
+		"argon2 memory": {Argon2: &kht.Argon2Params{Time: 1, Memory: math.MaxUint32, Threads: 1}, Salt: salt},
+		"root stretch":  {Stretch: kht.MaxRootStretch + 1},
+	}
+	for name, p := range tests {
+		t.Run(name, func(t *testing.T) {
+			p.Hash, p.BlockSize, p.MaxSize, p.Factor = "HMAC-SHA256", 16, 1024, 4
+			if _, err := kht.FromParams([]byte("yay"), p); err == nil {
+				t.Error("Built a tree with unbounded costs")
+			}
+		})
+	}
+
+	// The largest costs are accepted, without being computed here.
+	largest := kht.Params{
+		Hash: "HMAC-SHA256", BlockSize: 16, MaxSize: 1024, Factor: 4, Stretch: kht.MaxRootStretch,
+		Argon2: &kht.Argon2Params{Time: kht.MaxArgon2Time, Memory: kht.MaxArgon2Memory, Threads: 4}, Salt: salt,
+	}
+	if _, err := largest.MarshalBinary(); err != nil {
+		t.Errorf("Rejected the largest costs: %v", err)
+	}
+
+	// A tampered encoding is rejected before any key is hardened.
+	tree, err := kht.NewFromPassphrase([]byte("yay"), salt, cheapArgon2, kht.HMAC(sha256.New), 16, 1024, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The encoding ends with the memory, threads, and salt, and the memory is a
+	// single byte here.
+	i := len(data) - len(salt) - 3
+	if data[i] != byte(cheapArgon2.Memory) {
+		t.Fatalf("Memory was encoded as %d, but expected %d", data[i], cheapArgon2.Memory)
+	}
+
+	tampered := binary.AppendUvarint(bytes.Clone(data[:i]), math.MaxUint32)
+	tampered = append(tampered, data[i+1:]...)
+
+	var d kht.KeyedHashTree
+	if err := d.UnmarshalBinary(tampered); err == nil {
+		t.Error("Decoded a tree with unbounded Argon2 memory")
+	}
+}
@@ -0,0 +1,132 @@
+package kht
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// WithPrecompute returns an Option which derives the keys of every node in the
+// top levels of the tree below the root when its root key is set, so that
+// deriving any key starts from a precomputed node rather than from the root,
+// skipping that many levels. This trades memory for speed in read-heavy
+// workloads over a fixed tree: with a factor of 1024, precomputing one level
+// holds 1024 node keys, two levels over a million. Use PrecomputeSize to
+// estimate the memory needed. Levels beyond the tree's depth are ignored.
+//
+// Precomputed keys are secret, like cached keys (see WithNodeCache). They're
+// wiped when the root key changes, and subtrees don't inherit them.
+func WithPrecompute(levels int) Option {
+	return func(t *KeyedHashTree) {
+		t.preLevels = levels
+	}
+}
+
+// PrecomputeSize returns the number of bytes of node keys that a tree with t's
+// geometry and keyed hash would hold with WithPrecompute(levels), saturating
+// at the largest uint64.
+func (t *KeyedHashTree) PrecomputeSize(levels int) uint64 {
+	total := uint64(0)
+	for level := uint64(1); level <= min(uint64(max(levels, 0)), t.depth); level++ {
+		n := t.levelWidth(level)
+		if n > (math.MaxUint64-total)/uint64(t.hashSize) {
+			return math.MaxUint64
+		}
+		total += n * uint64(t.hashSize)
+	}
+	return total
+}
+
+// levelWidth returns the number of nodes at the given level of the tree.
+func (t *KeyedHashTree) levelWidth(level uint64) uint64 {
+	n := t.limit / t.sizes[level]
+	if t.limit%t.sizes[level] != 0 {
+		n++
+	}
+	return n
+}
+
+// maxPrecomputeSize is the most memory a tree will precompute keys into.
+const maxPrecomputeSize = math.MaxInt32
+
+// checkPrecompute returns an error if the tree's precomputed levels are out of
+// range.
+func (t *KeyedHashTree) checkPrecompute() error {
+	if t.preLevels < 0 {
+		return errors.New("kht: precomputed levels must not be negative")
+	}
+
+	if t.PrecomputeSize(t.preLevels) > maxPrecomputeSize {
+		return errors.New("kht: too many keys to precompute")
+	}
+	return nil
+}
+
+// precomputed holds the keys of every node in the top levels of a tree.
+type precomputed struct {
+	levels uint64
+	size   int
+	keys   [][]byte // keys[i] is the keys of level i, concatenated
+}
+
+// key returns the key of the precomputed node at the given level which
+// contains the given offset.
+func (p *precomputed) key(t *KeyedHashTree, level, offset uint64) []byte {
+	y := offset / t.sizes[level]
+	return p.keys[level][y*uint64(p.size) : (y+1)*uint64(p.size)]
+}
+
+// wipe zeroes every precomputed key.
+func (p *precomputed) wipe() {
+	for _, k := range p.keys {
+		Wipe(k)
+	}
+}
+
+// precompute replaces the tree's precomputed keys with those of its root key.
+func (t *KeyedHashTree) precompute() error {
+	if t.pre != nil {
+		t.pre.wipe()
+		t.pre = nil
+	}
+
+	levels := min(uint64(max(t.preLevels, 0)), t.depth)
+	if levels == 0 || t.top != 0 || t.root == nil {
+		return nil
+	}
+
+	if t.PrecomputeSize(t.preLevels) > maxPrecomputeSize {
+		return errors.New("kht: too many keys to precompute")
+	}
+
+	p := &precomputed{
+		levels: levels,
+		size:   t.hashSize,
+		keys:   make([][]byte, levels+1),
+	}
+
+	var buf [16]byte
+	parents := t.root
+	for level := uint64(1); level <= levels; level++ {
+		n := t.levelWidth(level)
+		keys := make([]byte, 0, n*uint64(p.size))
+		binary.LittleEndian.PutUint64(buf[:], level-1)
+		for y := range n {
+			parent := parents
+			if level > 1 {
+				j := y / t.factor * uint64(p.size)
+				parent = parents[j : j+uint64(p.size)]
+			}
+
+			binary.LittleEndian.PutUint64(buf[8:], y)
+			h := t.alg(parent)
+			_, _ = h.Write(buf[:])
+			keys = h.Sum(keys)
+			wipeHash(h)
+		}
+		p.keys[level] = keys
+		parents = keys
+	}
+	t.pre = p
+	return nil
+}
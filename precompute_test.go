@@ -0,0 +1,102 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestPrecompute(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 4096, 4)
+
+	for _, levels := range []int{1, 2, 5, 6, 10} {
+		r := new(recorder)
+		pre := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 4096, 4,
+			kht.WithPrecompute(levels), kht.WithObserver(r))
+
+		for offset := uint64(0); offset < 4096; offset += 37 {
+			if v, want := pre.Key(offset), tree.Key(offset); !bytes.Equal(v, want) {
+				t.Errorf("Key at %d with %d levels was %#v, but expected %#v", offset, levels, v, want)
+			}
+		}
+
+		d := r.reset()
+		if v, want := d[0].Hashes, uint64(max(int(tree.Depth())-levels, 0)); v != want {
+			t.Errorf("Derivation with %d levels took %d hashes, but expected %d", levels, v, want)
+		}
+
+		for _, n := range [][2]uint64{{0, 0}, {1, 3}, {3, 17}} {
+			k, err := pre.NodeKey(n[0], n[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, err := tree.NodeKey(n[0], n[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(k, want) {
+				t.Errorf("Node (%d, %d) was %#v, but expected %#v", n[0], n[1], k, want)
+			}
+		}
+	}
+}
+
+func TestPrecomputeSetKey(t *testing.T) {
+	pre := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 4096, 4, kht.WithPrecompute(2))
+	if err := pre.SetKey([]byte("boo")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := mustNew(t, []byte("boo"), kht.HMAC(md5.New), 2, 4096, 4)
+	if v, want := pre.Key(1000), want.Key(1000); !bytes.Equal(v, want) {
+		t.Errorf("Key was %#v, but expected %#v", v, want)
+	}
+
+	grown, err := pre.Grow(1 << 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantGrown, err := want.Grow(1 << 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := grown.Key(10000), wantGrown.Key(10000); !bytes.Equal(v, want) {
+		t.Errorf("Grown key was %#v, but expected %#v", v, want)
+	}
+
+	pre.Wipe()
+	if _, err := pre.KeyAt(0); err != kht.ErrNoKey {
+		t.Errorf("Error was %v, but expected ErrNoKey", err)
+	}
+}
+
+func TestPrecomputeSize(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 4096, 1<<40, 1024)
+
+	sizes := map[int]uint64{
+		-1: 0,
+		0:  0,
+		1:  1024 * 32,
+		2:  (1024 + 1024*1024) * 32,
+	}
+	for levels, want := range sizes {
+		if v := tree.PrecomputeSize(levels); v != want {
+			t.Errorf("Size of %d levels was %d, but expected %d", levels, v, want)
+		}
+	}
+
+	if _, err := kht.New([]byte("yay"), kht.HMAC(sha256.New), 4096, 1<<40, 1024, kht.WithPrecompute(3)); err == nil {
+		t.Error("Precomputed a billion keys")
+	}
+
+	if _, err := kht.New([]byte("yay"), kht.HMAC(sha256.New), 4096, 1<<40, 1024, kht.WithPrecompute(-1)); err == nil {
+		t.Error("Precomputed a negative number of levels")
+	}
+}
@@ -0,0 +1,151 @@
+package kht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// A RootKeyProvider computes keyed hashes with a root key it holds, such as a
+// KMS, an HSM, or a transit encryption service, so that the root key never
+// enters the application's memory. The provider's keyed hash must be the
+// tree's: for a tree using HMAC-SHA256, MAC must return HMAC-SHA256(root, msg).
+type RootKeyProvider interface {
+	// MAC returns the keyed hash of msg with the root key.
+	MAC(ctx context.Context, msg []byte) ([]byte, error)
+}
+
+// A ProvidedTree is a tree whose root key is held by a RootKeyProvider. The
+// provider derives the keys of the nodes at level 1, which are cached, and
+// every other key is derived locally from those. A ProvidedTree is safe for
+// concurrent use by multiple goroutines, except that Forget and Wipe, which
+// wipe the subtrees it has returned, must not be called concurrently with
+// anything using them.
+type ProvidedTree struct {
+	params   *KeyedHashTree
+	provider RootKeyProvider
+
+	mu       sync.Mutex
+	subtrees map[uint64]*KeyedHashTree
+	wiped    bool
+}
+
+// NewProvidedTree returns a tree with the given parameters whose root key is
+// held by the given provider. It returns an error if the parameters are
+// invalid, if they include root stretching or a context label (which would
+// require the root key itself), or if the tree's depth is zero, since then the
+// root key is the only key.
+func NewProvidedTree(provider RootKeyProvider, params Params) (*ProvidedTree, error) {
+	if params.Stretch > 0 || len(params.Context) > 0 || params.Argon2 != nil {
+		return nil, errors.New("kht: a provided root key can't be stretched or contextualized")
+	}
+
+	t, err := params.tree()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.depth == 0 {
+		return nil, errors.New("kht: a tree with a depth of zero can't have a provided root key")
+	}
+
+	return &ProvidedTree{
+		params:   t,
+		provider: provider,
+		subtrees: make(map[uint64]*KeyedHashTree),
+	}, nil
+}
+
+// Subtree returns the subtree rooted at the level-1 node containing the given
+// offset, which derives the same keys as the full tree for every offset the
+// node covers. The node's key is requested from the provider the first time
+// it's needed and cached afterwards. The subtree is shared with other callers,
+// and is wiped by Forget and Wipe. Subtree returns an *OffsetError if the
+// offset is out of range, and ErrNoKey if the tree has been wiped.
+func (t *ProvidedTree) Subtree(ctx context.Context, offset uint64) (*KeyedHashTree, error) {
+	if err := t.params.checkOffset(offset); err != nil {
+		return nil, err
+	}
+
+	index := offset / t.params.sizes[1]
+
+	t.mu.Lock()
+	sub, ok := t.subtrees[index]
+	wiped := t.wiped
+	t.mu.Unlock()
+	if wiped {
+		return nil, ErrNoKey
+	} else if ok {
+		return sub, nil
+	}
+
+	var msg [16]byte
+	binary.LittleEndian.PutUint64(msg[8:], index)
+	k, err := t.provider.MAC(ctx, msg[:])
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(k)
+
+	if len(k) != t.params.hashSize {
+		return nil, errors.New("kht: provider returned a key of the wrong length")
+	}
+
+	sub, err = t.params.NodeTree(Node{Level: 1, Index: index, Key: k})
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.wiped {
+		sub.Wipe()
+		return nil, ErrNoKey
+	}
+
+	if cached, ok := t.subtrees[index]; ok {
+		sub.Wipe()
+		return cached, nil // another goroutine got there first
+	}
+	t.subtrees[index] = sub
+	return sub, nil
+}
+
+// KeyAt returns the derived key at the given offset, requesting the key of its
+// level-1 ancestor from the provider if it isn't cached.
+func (t *ProvidedTree) KeyAt(ctx context.Context, offset uint64) ([]byte, error) {
+	sub, err := t.Subtree(ctx, offset)
+	if err != nil {
+		return nil, err
+	}
+	return sub.KeyAt(offset)
+}
+
+// Forget wipes and discards the cached level-1 keys, so they will be requested
+// from the provider again. Subtrees returned earlier are wiped too, and can no
+// longer derive keys.
+func (t *ProvidedTree) Forget() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.forget()
+}
+
+// Wipe wipes and discards the cached level-1 keys, after which the tree can't
+// derive keys. Like Forget, it wipes the subtrees returned earlier.
+func (t *ProvidedTree) Wipe() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.forget()
+	t.wiped = true
+}
+
+func (t *ProvidedTree) forget() {
+	for _, sub := range t.subtrees {
+		sub.Wipe()
+	}
+	clear(t.subtrees)
+}
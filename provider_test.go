@@ -0,0 +1,112 @@
+package kht_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+// hmacProvider stands in for a KMS holding an HMAC-SHA256 key.
+type hmacProvider struct {
+	key   []byte
+	calls int
+}
+
+func (p *hmacProvider) MAC(_ context.Context, msg []byte) ([]byte, error) {
+	p.calls++
+	h := hmac.New(sha256.New, p.key)
+	_, _ = h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func TestProvidedTree(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	params, err := tree.Params()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &hmacProvider{key: []byte("yay")}
+	provided, err := kht.NewProvidedTree(provider, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for offset := uint64(0); offset < 1024; offset += 8 {
+		k, err := provided.KeyAt(ctx, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := tree.Key(offset); !bytes.Equal(k, want) {
+			t.Errorf("Key for %d was %#v, but expected %#v", offset, k, want)
+		}
+	}
+
+	if provider.calls != 4 {
+		t.Errorf("Provider was called %d times, but expected 4", provider.calls)
+	}
+
+	sub, err := provided.Subtree(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provided.Forget()
+	if _, err := sub.KeyAt(0); !errors.Is(err, kht.ErrNoKey) {
+		t.Errorf("Forgotten subtree's error was %v, but expected ErrNoKey", err)
+	}
+
+	if _, err := provided.KeyAt(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if provider.calls != 5 {
+		t.Errorf("Provider was called %d times, but expected 5", provider.calls)
+	}
+
+	if _, err := provided.KeyAt(ctx, 1024); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+
+	if sub, err = provided.Subtree(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	provided.Wipe()
+	if _, err := sub.KeyAt(0); !errors.Is(err, kht.ErrNoKey) {
+		t.Errorf("Wiped subtree's error was %v, but expected ErrNoKey", err)
+	}
+
+	if _, err := provided.KeyAt(ctx, 0); !errors.Is(err, kht.ErrNoKey) {
+		t.Errorf("Wiped tree's error was %v, but expected ErrNoKey", err)
+	}
+
+	if provider.calls != 5 {
+		t.Errorf("Provider was called %d times, but expected 5", provider.calls)
+	}
+}
+
+func TestProvidedTreeInvalid(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4, kht.WithContext([]byte("data")))
+	params, err := tree.Params()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kht.NewProvidedTree(&hmacProvider{}, params); err == nil {
+		t.Error("Created a provided tree with a context label")
+	}
+
+	params.Context = nil
+	params.MaxSize = 16
+	if _, err := kht.NewProvidedTree(&hmacProvider{}, params); err == nil {
+		t.Error("Created a provided tree with a depth of zero")
+	}
+}
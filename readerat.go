@@ -0,0 +1,191 @@
+package kht
+
+import (
+	"errors"
+	"io"
+)
+
+var errWriteGap = errors.New("kht: write would leave a gap")
+
+// A blockFile maps a Deriver's offsets to sealed blocks in an underlying file.
+// Each block is sealed with SealBlock and stored at a fixed position, so the
+// block containing offset x is stored at
+// (x-base)/blockSize*(blockSize+overhead), where base is the first offset (a
+// subtree's, or 0) and the overhead is the cipher's nonce size plus its tag
+// size. Every block but the last is full-length.
+type blockFile struct {
+	b         *blockKeys
+	aead      AEAD
+	nonceSize uint64
+	overhead  uint64
+}
+
+func newBlockFile(d Deriver, aead AEAD) (*blockFile, error) {
+	b := newBlockKeys(d, false)
+	k, err := d.KeyAt(b.start)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := aead(k)
+	Wipe(k)
+	if err != nil {
+		return nil, err
+	}
+	return &blockFile{
+		b:         b,
+		aead:      aead,
+		nonceSize: uint64(c.NonceSize()),
+		overhead:  uint64(c.NonceSize() + c.Overhead()),
+	}, nil
+}
+
+// position returns the position of the sealed block containing the given
+// offset.
+func (f *blockFile) position(offset uint64) int64 {
+	return int64((offset - f.b.start) / f.b.blockSize * (f.b.blockSize + f.overhead))
+}
+
+// read returns the plaintext of the block containing the given offset, or an
+// empty slice if the block hasn't been written.
+func (f *blockFile) read(r io.ReaderAt, offset uint64, buf []byte) ([]byte, error) {
+	buf = buf[:f.b.blockSize+f.overhead]
+	n, err := r.ReadAt(buf, f.position(offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if n == 0 {
+		return buf[:0], nil
+	}
+	return openBlock(f.b, f.aead, offset, buf[:n], buf[f.nonceSize:f.nonceSize])
+}
+
+// NewReaderAt returns a reader which decrypts blocks written by NewWriterAt
+// from r, using ciphers from aead keyed with each block's key from d. Reads may
+// start at any offset within d's range (a tree's covered size, or any other
+// Deriver's MaxSize) and span any number of blocks; every block they touch is
+// read and authenticated in its entirety.
+func NewReaderAt(r io.ReaderAt, d Deriver, aead AEAD) (io.ReaderAt, error) {
+	f, err := newBlockFile(d, aead)
+	if err != nil {
+		return nil, err
+	}
+	return &readerAt{f: f, r: r}, nil
+}
+
+type readerAt struct {
+	f *blockFile
+	r io.ReaderAt
+}
+
+func (ra *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	b := ra.f.b
+	if off < 0 || uint64(off) < b.start {
+		return 0, b.checkOffset(uint64(max(off, 0)))
+	}
+
+	buf := make([]byte, b.blockSize+ra.f.overhead)
+	n := 0
+	for offset := uint64(off); n < len(p); offset = uint64(off) + uint64(n) {
+		if offset >= b.end {
+			return n, io.EOF
+		}
+
+		block, err := ra.f.read(ra.r, offset, buf)
+		if err != nil {
+			return n, err
+		}
+
+		i := offset % b.blockSize
+		if i >= uint64(len(block)) {
+			return n, io.EOF
+		}
+
+		n += copy(p[n:], block[i:])
+		if uint64(len(block)) < b.blockSize && n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// A ReadWriterAt is the underlying storage of a writer returned by NewWriterAt.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// NewWriterAt returns a writer which encrypts data into rw, using ciphers from
+// aead keyed with each block's key from d. Partial writes to a block read,
+// decrypt, and re-seal the whole block. A write may extend the final block or
+// start the block after it, but it may not start beyond that, since the blocks
+// in between would be missing.
+//
+// Blocks are sealed with SealBlock, which stores a random nonce with each
+// sealed block, so blocks can be rewritten in place, or extended by a series
+// of small writes, without reusing a nonce.
+func NewWriterAt(rw ReadWriterAt, d Deriver, aead AEAD) (io.WriterAt, error) {
+	f, err := newBlockFile(d, aead)
+	if err != nil {
+		return nil, err
+	}
+	return &writerAt{f: f, rw: rw}, nil
+}
+
+type writerAt struct {
+	f  *blockFile
+	rw ReadWriterAt
+}
+
+func (wa *writerAt) WriteAt(p []byte, off int64) (int, error) {
+	b := wa.f.b
+	if off < 0 || uint64(off) < b.start {
+		return 0, b.checkOffset(uint64(max(off, 0)))
+	}
+
+	if uint64(len(p)) > b.end-min(uint64(off), b.end) {
+		return 0, errWritePastMax
+	}
+
+	buf := make([]byte, b.blockSize+wa.f.overhead)
+	out := make([]byte, 0, b.blockSize+wa.f.overhead)
+	n := 0
+	for n < len(p) {
+		offset := uint64(off) + uint64(n)
+		block, err := wa.f.read(wa.rw, offset, buf)
+		if err != nil {
+			return n, err
+		}
+
+		if len(block) == 0 && offset-offset%b.blockSize > b.start {
+			prev, err := wa.f.read(wa.rw, offset-offset%b.blockSize-1, out)
+			if err != nil {
+				return n, err
+			}
+
+			if uint64(len(prev)) < b.blockSize {
+				return n, errWriteGap
+			}
+		}
+
+		i := offset % b.blockSize
+		if i > uint64(len(block)) {
+			block = append(block, make([]byte, i-uint64(len(block)))...)
+		}
+
+		c := copy(block[i:cap(block)][:b.blockSize-i], p[n:])
+		block = block[:max(uint64(len(block)), i+uint64(c))]
+
+		out, err = sealBlock(b, wa.f.aead, offset, block, out[:0])
+		if err != nil {
+			return n, err
+		}
+
+		if _, err := wa.rw.WriteAt(out, wa.f.position(offset)); err != nil {
+			return n, err
+		}
+		n += c
+	}
+	return n, nil
+}
@@ -0,0 +1,152 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+// memFile is an in-memory ReadWriterAt.
+type memFile struct {
+	b []byte
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f.b)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(f.b) {
+		f.b = append(f.b, make([]byte, end-len(f.b))...)
+	}
+	return copy(f.b[off:], p), nil
+}
+
+func TestReaderAtWriterAt(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	plaintext := bytes.Repeat([]byte("abcdefghij"), 10)
+
+	f := new(memFile)
+	w, err := kht.NewWriterAt(f, tree, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(plaintext); i += 7 {
+		if _, err := w.WriteAt(plaintext[i:min(i+7, len(plaintext))], int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(f.b); n != 6*44+4+28 {
+		t.Errorf("Ciphertext was %d bytes, but expected %d", n, 6*44+4+28)
+	}
+
+	r, err := kht.NewReaderAt(f, tree, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, span := range [][2]int{{0, 100}, {3, 20}, {16, 32}, {50, 99}, {90, 100}} {
+		p := make([]byte, span[1]-span[0])
+		if _, err := r.ReadAt(p, int64(span[0])); err != nil {
+			t.Fatal(err)
+		}
+
+		if want := plaintext[span[0]:span[1]]; !bytes.Equal(p, want) {
+			t.Errorf("Read of %v was %q, but expected %q", span, p, want)
+		}
+	}
+
+	p := make([]byte, 20)
+	if n, err := r.ReadAt(p, 90); n != 10 || err != io.EOF {
+		t.Errorf("Read past the end was (%d, %v), but expected (10, EOF)", n, err)
+	}
+
+	if _, err := w.WriteAt([]byte("XYZ"), 14); err != nil {
+		t.Fatal(err)
+	}
+
+	p = make([]byte, 6)
+	if _, err := r.ReadAt(p, 12); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []byte("cdXYZh"); !bytes.Equal(p, want) {
+		t.Errorf("Read after overwrite was %q, but expected %q", p, want)
+	}
+
+	f.b[50] ^= 1
+	if _, err := r.ReadAt(p, 16); err == nil {
+		t.Error("Read a modified block")
+	}
+}
+
+func TestWriterAtNonces(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+
+	f := new(memFile)
+	w, err := kht.NewWriterAt(f, tree, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nonces [][]byte
+	for i, p := range []string{"abc", "def"} {
+		if _, err := w.WriteAt([]byte(p), int64(3*i)); err != nil {
+			t.Fatal(err)
+		}
+		nonces = append(nonces, bytes.Clone(f.b[:12]))
+	}
+
+	if bytes.Equal(nonces[0], nonces[1]) {
+		t.Error("Two partial writes to a block reused a nonce")
+	}
+
+	r, err := kht.NewReaderAt(f, tree, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := make([]byte, 6)
+	if _, err := r.ReadAt(p, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if want := []byte("abcdef"); !bytes.Equal(p, want) {
+		t.Errorf("Read was %q, but expected %q", p, want)
+	}
+}
+
+func TestWriterAtInvalid(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+
+	w, err := kht.NewWriterAt(new(memFile), tree, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.WriteAt([]byte("yay"), 40); err == nil {
+		t.Error("Wrote past a gap")
+	}
+
+	if _, err := w.WriteAt([]byte("yay"), 1022); err == nil {
+		t.Error("Wrote past the covered size")
+	}
+
+	if _, err := kht.NewReaderAt(new(memFile), new(kht.KeyedHashTree), kht.AESGCM); !errors.Is(err, kht.ErrNoKey) {
+		t.Errorf("Error was %v, but expected ErrNoKey", err)
+	}
+}
@@ -0,0 +1,117 @@
+package kht
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ReEncrypt re-encrypts the first length bytes of plaintext stored in src by a
+// writer from NewWriterAt, decrypting each block with oldTree's keys and
+// sealing it with newTree's, and writes them to dst in the same layout, so
+// they can be read with a reader from NewReaderAt and newTree. Both trees'
+// blocks are sealed with ciphers from aead. src and dst may be the same file,
+// since each block is read before it's rewritten and no block is written more
+// than once.
+//
+// Memory use is bounded by the number of workers: each block is re-encrypted
+// by one of workers goroutines, which each hold a single block at a time.
+// Fewer than two workers re-encrypt the blocks sequentially.
+//
+// Re-encryption proceeds in order, and after each run of blocks it calls
+// progress (if it isn't nil) with the number of leading bytes which have been
+// re-encrypted. If re-encryption is interrupted, passing the last value given
+// to progress as start resumes it from there; start is rounded down to the
+// beginning of its block.
+//
+// ReEncrypt returns an error if the trees have different block sizes or first
+// offsets, an *OffsetError if either tree doesn't cover the plaintext, ErrNoKey
+// if either tree has no root key, and the first error returned by src, dst, or
+// a block's decryption.
+func ReEncrypt(src io.ReaderAt, dst io.WriterAt, oldTree, newTree *KeyedHashTree, aead AEAD, start, length uint64, workers int, progress func(done uint64)) error {
+	if oldTree.blockSize != newTree.blockSize || oldTree.base != newTree.base {
+		return errors.New("kht: can't re-encrypt between trees with different blocks")
+	}
+
+	if start >= length {
+		return nil
+	}
+
+	from, err := newBlockFile(oldTree, aead)
+	if err != nil {
+		return err
+	}
+
+	to, err := newBlockFile(newTree, aead)
+	if err != nil {
+		return err
+	}
+
+	base, bs := oldTree.base, oldTree.blockSize
+	for _, t := range []*KeyedHashTree{oldTree, newTree} {
+		if err := t.checkOffset(base + length - 1); err != nil {
+			return err
+		}
+	}
+
+	workers = max(workers, 1)
+	first, last := start/bs, (length-1)/bs
+	for i := first; i <= last; i += uint64(workers) {
+		n := min(uint64(workers), last-i+1)
+
+		var (
+			wg   sync.WaitGroup
+			once sync.Once
+			err  error
+		)
+		for j := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				offset := base + (i+j)*bs
+				size := min(bs, length-(i+j)*bs)
+				if e := reEncryptBlock(src, dst, from, to, offset, size); e != nil {
+					once.Do(func() { err = e })
+				}
+			}()
+		}
+		wg.Wait()
+
+		if err != nil {
+			return err
+		}
+
+		if progress != nil {
+			progress(min((i+n)*bs, length))
+		}
+	}
+	return nil
+}
+
+// reEncryptBlock re-encrypts the block containing the given offset, which
+// holds size bytes of plaintext.
+func reEncryptBlock(src io.ReaderAt, dst io.WriterAt, from, to *blockFile, offset, size uint64) error {
+	buf := make([]byte, size+max(from.overhead, to.overhead))
+	sealed := buf[:size+from.overhead]
+	if n, err := src.ReadAt(sealed, from.position(offset)); n < len(sealed) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	plaintext, err := openBlock(from.b, from.aead, offset, sealed, buf[from.nonceSize:from.nonceSize])
+	if err != nil {
+		return err
+	}
+	defer Wipe(plaintext)
+
+	out, err := sealBlock(to.b, to.aead, offset, plaintext, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = dst.WriteAt(out, to.position(offset))
+	return err
+}
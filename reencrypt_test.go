@@ -0,0 +1,139 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+// failingFile fails reads after a number of them have succeeded.
+type failingFile struct {
+	*memFile
+	mu    sync.Mutex
+	reads int
+}
+
+var errInjected = errors.New("injected failure")
+
+func (f *failingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.reads == 0 {
+		return 0, errInjected
+	}
+	f.reads--
+	return f.memFile.ReadAt(p, off)
+}
+
+func encryptedFile(t *testing.T, tree *kht.KeyedHashTree, plaintext []byte) *memFile {
+	t.Helper()
+
+	f := new(memFile)
+	w, err := kht.NewWriterAt(f, tree, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.WriteAt(plaintext, 0); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func checkDecrypts(t *testing.T, f *memFile, tree *kht.KeyedHashTree, want []byte) {
+	t.Helper()
+
+	r, err := kht.NewReaderAt(f, tree, kht.AESGCM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(want))
+	if _, err := r.ReadAt(got, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("Plaintext was %q, but expected %q", got, want)
+	}
+}
+
+func TestReEncrypt(t *testing.T) {
+	old := mustNew(t, []byte("old"), kht.HMAC(sha256.New), 16, 1024, 4)
+	tree := mustNew(t, []byte("new"), kht.HMAC(sha256.New), 16, 1024, 4)
+	plaintext := bytes.Repeat([]byte("abcdefghij"), 10)
+
+	for _, workers := range []int{0, 1, 3, 8} {
+		src := encryptedFile(t, old, plaintext)
+		dst := &memFile{b: make([]byte, len(src.b))}
+
+		var done []uint64
+		progress := func(n uint64) { done = append(done, n) }
+		if err := kht.ReEncrypt(src, dst, old, tree, kht.AESGCM, 0, uint64(len(plaintext)), workers, progress); err != nil {
+			t.Fatal(err)
+		}
+
+		checkDecrypts(t, dst, tree, plaintext)
+
+		if v := done[len(done)-1]; v != uint64(len(plaintext)) {
+			t.Errorf("Final progress with %d workers was %d, but expected %d", workers, v, len(plaintext))
+		}
+	}
+}
+
+func TestReEncryptResume(t *testing.T) {
+	old := mustNew(t, []byte("old"), kht.HMAC(sha256.New), 16, 1024, 4)
+	tree := mustNew(t, []byte("new"), kht.HMAC(sha256.New), 16, 1024, 4)
+	plaintext := bytes.Repeat([]byte("abcdefghij"), 10)
+
+	f := encryptedFile(t, old, plaintext)
+	var checkpoint uint64
+	progress := func(n uint64) { checkpoint = n }
+
+	// Re-encrypt in place, failing partway through.
+	failing := &failingFile{memFile: f, reads: 4}
+	err := kht.ReEncrypt(failing, f, old, tree, kht.AESGCM, 0, uint64(len(plaintext)), 2, progress)
+	if err != errInjected {
+		t.Fatalf("Error was %v, but expected %v", err, errInjected)
+	}
+
+	if want := uint64(64); checkpoint != want {
+		t.Errorf("Checkpoint was %d, but expected %d", checkpoint, want)
+	}
+
+	if err := kht.ReEncrypt(f, f, old, tree, kht.AESGCM, checkpoint, uint64(len(plaintext)), 2, progress); err != nil {
+		t.Fatal(err)
+	}
+
+	checkDecrypts(t, f, tree, plaintext)
+}
+
+func TestReEncryptInvalid(t *testing.T) {
+	old := mustNew(t, []byte("old"), kht.HMAC(sha256.New), 16, 1024, 4)
+	tree := mustNew(t, []byte("new"), kht.HMAC(sha256.New), 16, 1024, 4)
+	other := mustNew(t, []byte("new"), kht.HMAC(sha256.New), 32, 1024, 4)
+	plaintext := bytes.Repeat([]byte("abcdefghij"), 10)
+	f := encryptedFile(t, old, plaintext)
+
+	if err := kht.ReEncrypt(f, new(memFile), old, other, kht.AESGCM, 0, 100, 1, nil); err == nil {
+		t.Error("Re-encrypted between trees with different block sizes")
+	}
+
+	if err := kht.ReEncrypt(f, new(memFile), old, tree, kht.AESGCM, 0, 2048, 1, nil); err == nil {
+		t.Error("Re-encrypted past the end of the trees")
+	}
+
+	if err := kht.ReEncrypt(f, new(memFile), tree, old, kht.AESGCM, 0, 100, 1, nil); err == nil {
+		t.Error("Re-encrypted with the wrong old tree")
+	}
+
+	if err := kht.ReEncrypt(f, new(memFile), old, tree, kht.AESGCM, 0, 200, 1, nil); err != io.ErrUnexpectedEOF {
+		t.Errorf("Error for a short file was %v, but expected %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -0,0 +1,69 @@
+package kht
+
+import (
+	"errors"
+	"iter"
+)
+
+// A Rotation is the old and new keys of a block, for re-encrypting it.
+type Rotation struct {
+	Offset   uint64 // the first offset of the block
+	Old, New []byte // the block's keys in the old and new trees
+}
+
+// Rotate returns an iterator over the old and new keys of the blocks
+// containing the bytes in [start, end), in offset order, for re-encrypting data
+// encrypted with from's keys with to's. Each tree's keys are derived
+// sequentially, reusing the ancestor nodes shared between adjacent blocks.
+//
+// Rotation can be interrupted and resumed: after re-encrypting a block, record
+// the offset of the next one (Offset plus the block size) as a checkpoint, and
+// pass it as start to resume from there. The keys yielded are only valid for
+// the duration of each iteration.
+//
+// Rotate returns an error if the trees have different block sizes, an
+// *OffsetError if either tree doesn't cover the range, and ErrNoKey if either
+// tree has no root key.
+func Rotate(from, to *KeyedHashTree, start, end uint64) (iter.Seq[Rotation], error) {
+	if from.blockSize != to.blockSize {
+		return nil, errors.New("kht: can't rotate between trees with different block sizes")
+	}
+
+	for _, t := range []*KeyedHashTree{from, to} {
+		if t.root == nil {
+			return nil, ErrNoKey
+		}
+
+		if start >= end {
+			continue
+		}
+
+		if err := t.checkOffset(start); err != nil {
+			return nil, err
+		}
+
+		if err := t.checkOffset(end - 1); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(yield func(Rotation) bool) {
+		if start >= end {
+			return
+		}
+
+		old, cur := newCursor(from), newCursor(to)
+		defer old.wipe()
+		defer cur.wipe()
+
+		for offset := start - start%from.blockSize; ; offset += from.blockSize {
+			r := Rotation{Offset: offset, Old: old.key(offset), New: cur.key(offset)}
+			ok := yield(r)
+			Wipe(r.Old)
+			Wipe(r.New)
+			if !ok || end-1-offset < from.blockSize {
+				return
+			}
+		}
+	}, nil
+}
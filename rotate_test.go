@@ -0,0 +1,69 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestRotate(t *testing.T) {
+	from := mustNew(t, []byte("old"), kht.HMAC(sha256.New), 16, 1024, 4)
+	to := mustNew(t, []byte("new"), kht.HMAC(sha256.New), 16, 4096, 8)
+
+	rotations, err := kht.Rotate(from, to, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var checkpoint uint64
+	for r := range rotations {
+		if r.Offset != checkpoint {
+			t.Errorf("Offset was %d, but expected %d", r.Offset, checkpoint)
+		}
+
+		if want := from.Key(r.Offset); !bytes.Equal(r.Old, want) {
+			t.Errorf("Old key for %d was %#v, but expected %#v", r.Offset, r.Old, want)
+		}
+
+		if want := to.Key(r.Offset); !bytes.Equal(r.New, want) {
+			t.Errorf("New key for %d was %#v, but expected %#v", r.Offset, r.New, want)
+		}
+
+		checkpoint = r.Offset + 16
+		if checkpoint == 48 {
+			break // interrupted
+		}
+	}
+
+	rotations, err = kht.Rotate(from, to, checkpoint, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for r := range rotations {
+		if r.Offset != checkpoint {
+			t.Errorf("Offset was %d, but expected %d", r.Offset, checkpoint)
+		}
+		checkpoint = r.Offset + 16
+	}
+
+	if checkpoint != 112 {
+		t.Errorf("Rotation ended at %d, but expected 112", checkpoint)
+	}
+}
+
+func TestRotateInvalid(t *testing.T) {
+	from := mustNew(t, []byte("old"), kht.HMAC(sha256.New), 16, 1024, 4)
+
+	if _, err := kht.Rotate(from, mustNew(t, []byte("new"), kht.HMAC(sha256.New), 32, 1024, 4), 0, 100); err == nil {
+		t.Error("Rotated between trees with different block sizes")
+	}
+
+	small := mustNew(t, []byte("new"), kht.HMAC(sha256.New), 16, 64, 4)
+	if _, err := kht.Rotate(from, small, 0, 100); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+}
@@ -0,0 +1,333 @@
+package kht
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// An AEAD returns an authenticated cipher for the given derived key.
+type AEAD func(key []byte) (cipher.AEAD, error)
+
+var (
+	errWritePastMax = errors.New("kht: write past covered size")
+	errClosed       = errors.New("kht: write to closed writer")
+)
+
+// NewEncryptWriter returns a writer which encrypts data in block-sized chunks
+// and writes the ciphertext to dst. It's NewEncryptWriter with the tree as the
+// Deriver, so blocks are written starting at the tree's first offset (which is
+// 0 unless the tree is a subtree).
+func (t *KeyedHashTree) NewEncryptWriter(dst io.Writer, aead AEAD) io.WriteCloser {
+	return NewEncryptWriter(t, dst, aead)
+}
+
+// NewEncryptWriter returns a writer which encrypts data in block-sized chunks
+// and writes the ciphertext to dst. Blocks are written in offset order,
+// starting at d's first offset (which is 0 unless d is a subtree), and each is
+// sealed with a cipher from aead keyed with the block's derived key. The
+// stream may extend to a tree's CoveredSize, or to any other Deriver's
+// MaxSize.
+//
+// Blocks are sealed as in STREAM (Hoang, Reyhanitabar, Rogaway, and Vizár,
+// 2015): each block's nonce is the same as EncryptBlock's (for a tree, its
+// nonce from KeyNonce), and its additional data is its offset (as a
+// little-endian uint64) followed by a byte which is 1 for the final block and 0
+// for every other. A reader from NewDecryptReader can therefore detect a stream
+// which has been truncated, even at a block boundary. Each ciphertext block is
+// the block size plus the cipher's overhead, except for the final block, which
+// may be shorter; if the plaintext is a whole number of blocks, or empty, the
+// final block is the last full block, or an empty one. Close must be called to
+// write the final block; it does not close dst. A tree's keys are derived
+// sequentially, reusing the ancestor nodes shared between adjacent blocks.
+//
+// Since the nonces are those of EncryptBlock, each block should be encrypted
+// once, by either.
+func NewEncryptWriter(d Deriver, dst io.Writer, aead AEAD) io.WriteCloser {
+	b := newBlockKeys(d, true)
+	return &encryptWriter{
+		b:      b,
+		dst:    dst,
+		aead:   aead,
+		buf:    make([]byte, 0, b.blockSize),
+		offset: b.start,
+	}
+}
+
+type encryptWriter struct {
+	b        *blockKeys
+	dst      io.Writer
+	aead     AEAD
+	buf, out []byte
+	offset   uint64
+	err      error
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// A full block is only sealed once more data arrives, since until then
+		// it might be the final block.
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(false); err != nil {
+				return n, err
+			}
+		}
+
+		i := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+i]
+		p = p[i:]
+		n += i
+	}
+	return n, nil
+}
+
+func (w *encryptWriter) Close() error {
+	if w.err != nil {
+		if w.err == errClosed {
+			return nil
+		}
+		return w.err
+	}
+
+	if err := w.flush(true); err != nil {
+		return err
+	}
+	w.b.wipe()
+	w.err = errClosed
+	return nil
+}
+
+func (w *encryptWriter) flush(final bool) error {
+	// Only the final block may end at the end of the tree.
+	if n, room := uint64(len(w.buf)), w.b.end-w.offset; n > room || !final && n == room {
+		w.err = errWritePastMax
+		return w.err
+	}
+
+	c, nonce, err := w.b.cipher(w.aead, w.offset, true)
+	if err != nil {
+		w.err = err
+		return err
+	}
+
+	ad := streamAD(w.offset, final)
+	w.out = c.Seal(w.out[:0], nonce, w.buf, ad[:])
+	if _, err := w.dst.Write(w.out); err != nil {
+		w.err = err
+		return err
+	}
+
+	w.offset += uint64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// streamAD returns the additional data for the stream block at the given
+// offset.
+func streamAD(offset uint64, final bool) [9]byte {
+	var ad [9]byte
+	binary.LittleEndian.PutUint64(ad[:], offset)
+	if final {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// errTruncated is returned when a stream ends without its final block.
+var errTruncated = errors.New("kht: stream truncated")
+
+// NewDecryptReader returns a reader which decrypts the ciphertext written by
+// NewEncryptWriter from src, starting at the tree's first offset. It's
+// NewDecryptReader with the tree as the Deriver.
+func (t *KeyedHashTree) NewDecryptReader(src io.Reader, aead AEAD) io.Reader {
+	return NewDecryptReader(t, src, aead)
+}
+
+// NewDecryptReader returns a reader which decrypts the ciphertext written by
+// NewEncryptWriter with d from src, starting at d's first offset. A tree's keys
+// are derived sequentially, reusing the ancestor nodes shared between adjacent
+// blocks. Read returns an error if a block isn't authentic, if src ends
+// without the stream's final block (i.e., the stream has been truncated), or if
+// src holds more blocks than d covers.
+func NewDecryptReader(d Deriver, src io.Reader, aead AEAD) io.Reader {
+	b := newBlockKeys(d, true)
+	return &decryptReader{
+		b:      b,
+		src:    src,
+		aead:   aead,
+		offset: b.start,
+	}
+}
+
+type decryptReader struct {
+	b        *blockKeys
+	src      io.Reader
+	aead     AEAD
+	buf, out []byte
+	next     []byte // the first byte of the next block, if it's been read
+	offset   uint64
+	err      error
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill reads and opens the next block, setting r.err if there are no more.
+func (r *decryptReader) fill() {
+	if r.offset >= r.b.end {
+		r.stop(r.eof())
+		return
+	}
+
+	c, nonce, err := r.b.cipher(r.aead, r.offset, true)
+	if err != nil {
+		r.stop(err)
+		return
+	}
+
+	// Read one byte past the block, to find out whether it's the final block.
+	size := int(r.b.blockSize) + c.Overhead()
+	if r.buf == nil {
+		r.buf = make([]byte, size+1)
+	}
+
+	n := copy(r.buf, r.next)
+	m, err := io.ReadFull(r.src, r.buf[n:])
+	n += m
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		r.stop(err)
+		return
+	}
+
+	if n == 0 {
+		r.stop(errTruncated)
+		return
+	}
+
+	final := n <= size
+	ad := streamAD(r.offset, final)
+	r.next = r.next[:0]
+	if !final {
+		r.next = append(r.next, r.buf[size])
+		n = size
+	}
+
+	r.out, err = c.Open(r.buf[:0], nonce, r.buf[:n], ad[:])
+	if err != nil {
+		r.stop(err)
+		return
+	}
+
+	r.offset += r.b.blockSize
+	if final {
+		r.stop(io.EOF)
+	}
+}
+
+// eof returns errTruncated if src has no more data, since the final block
+// hasn't been read, and an *OffsetError otherwise.
+func (r *decryptReader) eof() error {
+	var b [1]byte
+	if n, _ := io.ReadFull(r.src, b[:]); n == 0 && len(r.next) == 0 {
+		return errTruncated
+	}
+	return r.b.checkOffset(r.offset)
+}
+
+func (r *decryptReader) stop(err error) {
+	r.b.wipe()
+	r.err = err
+}
+
+// VerifyStream reads length bytes of ciphertext from ct in block-sized chunks,
+// calling open with each chunk's offset, derived key, and ciphertext to check
+// its authenticity, starting at the tree's first offset. Ciphertext blocks are
+// assumed to be the tree's block size, as with length-preserving ciphers whose
+// authenticators are stored elsewhere; the final block may be shorter.
+//
+// Keys are derived sequentially, reusing the ancestor nodes shared between
+// adjacent blocks, and only one block is held in memory at a time. If open
+// returns false for a block, or if ct ends before length bytes have been read,
+// VerifyStream returns false and the offset of the offending block. Otherwise,
+// it returns true.
+func (t *KeyedHashTree) VerifyStream(ct io.Reader, length uint64, open func(offset uint64, key, ctBlock []byte) bool) (ok bool, firstBadOffset uint64) {
+	c := newCursor(t)
+	defer c.wipe()
+
+	buf := make([]byte, t.blockSize)
+	for i := uint64(0); i < length; i += t.blockSize {
+		offset := t.base + i
+		n := min(t.blockSize, length-i)
+
+		if t.checkOffset(offset) != nil {
+			return false, offset
+		}
+
+		if _, err := io.ReadFull(ct, buf[:n]); err != nil {
+			return false, offset
+		}
+
+		k := c.key(offset)
+		ok := open(offset, k, buf[:n])
+		Wipe(k)
+		if !ok {
+			return false, offset
+		}
+	}
+	return true, 0
+}
+
+// EachBlock reads r in block-sized chunks, calling fn with each chunk's offset,
+// derived key, and contents. The final block may be shorter than the block
+// size. EachBlock stops at the first error returned by fn or encountered while
+// reading r, and returns it, or an *OffsetError if r holds more data than the
+// tree covers. Keys are derived sequentially, reusing the ancestor nodes shared
+// between adjacent blocks. The key and block passed to fn are only valid for
+// the duration of the call.
+func (t *KeyedHashTree) EachBlock(r io.Reader, fn func(offset uint64, key, block []byte) error) error {
+	c := newCursor(t)
+	defer c.wipe()
+
+	buf := make([]byte, t.blockSize)
+	for offset := t.base; ; offset += t.blockSize {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return nil
+		} else if n == 0 {
+			return err
+		}
+
+		if err := t.checkOffset(offset); err != nil {
+			return err
+		}
+
+		k := c.key(offset)
+		cbErr := fn(offset, k, buf[:n])
+		Wipe(k)
+		if cbErr != nil {
+			return cbErr
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
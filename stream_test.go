@@ -0,0 +1,286 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"testing/iotest"
+
+	"github.com/codahale/kht"
+)
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+func TestEncryptWriter(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	plaintext := bytes.Repeat([]byte("abcdefghij"), 5)
+
+	buf := new(bytes.Buffer)
+	w := tree.NewEncryptWriter(buf, aesGCM)
+	for _, b := range plaintext {
+		if _, err := w.Write([]byte{b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var decrypted []byte
+	ciphertext := buf.Bytes()
+	for offset := uint64(0); len(ciphertext) > 0; offset += 16 {
+		key, nonce := tree.KeyNonce(offset, 12)
+		c, err := aesGCM(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := 16 + c.Overhead()
+		if n > len(ciphertext) {
+			n = len(ciphertext)
+		}
+
+		ad := make([]byte, 9)
+		binary.LittleEndian.PutUint64(ad, offset)
+		if n == len(ciphertext) {
+			ad[8] = 1 // the final block
+		}
+
+		p, err := c.Open(nil, nonce, ciphertext[:n], ad)
+		if err != nil {
+			t.Fatalf("Block at %d didn't decrypt: %v", offset, err)
+		}
+		decrypted = append(decrypted, p...)
+		ciphertext = ciphertext[n:]
+	}
+
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Plaintext was %q, but expected %q", decrypted, plaintext)
+	}
+}
+
+func TestEncryptWriterPastMaxSize(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 32, 2)
+	w := tree.NewEncryptWriter(new(bytes.Buffer), aesGCM)
+	if _, err := w.Write(make([]byte, 48)); err == nil {
+		t.Error("No error, but expected one")
+	}
+
+	// A stream which fills the tree ends with its last block.
+	buf := new(bytes.Buffer)
+	w = tree.NewEncryptWriter(buf, aesGCM)
+	if _, err := w.Write(make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pt, err := io.ReadAll(tree.NewDecryptReader(buf, aesGCM))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pt) != 32 {
+		t.Errorf("Read %d bytes, but expected 32", len(pt))
+	}
+}
+
+func TestDecryptReader(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+
+	for _, size := range []int{0, 15, 16, 50, 64} {
+		plaintext := bytes.Repeat([]byte("a"), size)
+
+		buf := new(bytes.Buffer)
+		w := tree.NewEncryptWriter(buf, aesGCM)
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		pt, err := io.ReadAll(iotest.OneByteReader(tree.NewDecryptReader(buf, aesGCM)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(pt, plaintext) {
+			t.Errorf("Plaintext was %q, but expected %q", pt, plaintext)
+		}
+	}
+}
+
+func TestDecryptReaderTruncated(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+
+	for _, size := range []int{0, 16, 50, 64} {
+		buf := new(bytes.Buffer)
+		w := tree.NewEncryptWriter(buf, aesGCM)
+		if _, err := w.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Drop the final block, leaving only whole blocks.
+		ct := buf.Bytes()
+		ct = ct[:len(ct)-(len(ct)-1)%32-1]
+		if _, err := io.ReadAll(tree.NewDecryptReader(bytes.NewReader(ct), aesGCM)); err == nil {
+			t.Errorf("Read a %d-byte stream truncated to %d bytes", size, len(ct))
+		}
+	}
+}
+
+func TestDecryptReaderModified(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+
+	buf := new(bytes.Buffer)
+	w := tree.NewEncryptWriter(buf, aesGCM)
+	if _, err := w.Write(make([]byte, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ct := buf.Bytes()
+	ct[40] ^= 1
+
+	pt, err := io.ReadAll(tree.NewDecryptReader(bytes.NewReader(ct), aesGCM))
+	if err == nil {
+		t.Error("Read a modified stream")
+	}
+
+	if len(pt) != 16 {
+		t.Errorf("Read %d bytes before the modified block, but expected 16", len(pt))
+	}
+
+	ct[40] ^= 1
+	leaf, err := tree.Subtree(3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadAll(leaf.NewDecryptReader(bytes.NewReader(ct), aesGCM)); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+}
+
+func TestVerifyStream(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	open := func(offset uint64, key, ctBlock []byte) bool {
+		if !bytes.Equal(key, tree.Key(offset)) {
+			t.Errorf("Key for %d was %#v, but expected %#v", offset, key, tree.Key(offset))
+		}
+		return ctBlock[0] != 'x'
+	}
+
+	ct := bytes.Repeat([]byte("a"), 1000)
+	if ok, _ := tree.VerifyStream(bytes.NewReader(ct), uint64(len(ct)), open); !ok {
+		t.Error("Stream failed verification")
+	}
+
+	ct[480] = 'x'
+	if ok, offset := tree.VerifyStream(bytes.NewReader(ct), uint64(len(ct)), open); ok || offset != 480 {
+		t.Errorf("Verification was %v at %d, but expected a failure at 480", ok, offset)
+	}
+
+	if ok, offset := tree.VerifyStream(bytes.NewReader(ct[:100]), uint64(len(ct)), open); ok || offset != 96 {
+		t.Errorf("Verification was %v at %d, but expected a failure at 96", ok, offset)
+	}
+}
+
+func TestVerifyStreamSubtree(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	sub, err := tree.Subtree(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offsets []uint64
+	open := func(offset uint64, key, ctBlock []byte) bool {
+		if !bytes.Equal(key, tree.Key(offset)) {
+			t.Errorf("Key for %d was %#v, but expected %#v", offset, key, tree.Key(offset))
+		}
+		offsets = append(offsets, offset)
+		return ctBlock[0] != 'x'
+	}
+
+	ct := bytes.Repeat([]byte("a"), 40)
+	if ok, _ := sub.VerifyStream(bytes.NewReader(ct), uint64(len(ct)), open); !ok {
+		t.Error("Subtree stream failed verification")
+	}
+
+	if want := []uint64{256, 272, 288}; !slices.Equal(offsets, want) {
+		t.Errorf("Offsets were %v, but expected %v", offsets, want)
+	}
+
+	ct[16] = 'x'
+	if ok, offset := sub.VerifyStream(bytes.NewReader(ct), uint64(len(ct)), open); ok || offset != 272 {
+		t.Errorf("Verification was %v at %d, but expected a failure at 272", ok, offset)
+	}
+
+	if ok, offset := sub.VerifyStream(bytes.NewReader(make([]byte, 300)), 300, open); ok || offset != 512 {
+		t.Errorf("Verification was %v at %d, but expected a failure at 512", ok, offset)
+	}
+}
+
+func TestEachBlock(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 16, 1024, 4)
+	data := bytes.Repeat([]byte("abcdefghij"), 5)
+
+	var offsets []uint64
+	var blocks []byte
+	err := tree.EachBlock(bytes.NewReader(data), func(offset uint64, key, block []byte) error {
+		if want := tree.Key(offset); !bytes.Equal(key, want) {
+			t.Errorf("Key for %d was %#v, but expected %#v", offset, key, want)
+		}
+
+		if len(block) != 16 && offset != 48 {
+			t.Errorf("Block at %d was %d bytes long", offset, len(block))
+		}
+
+		offsets = append(offsets, offset)
+		blocks = append(blocks, block...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(blocks, data) {
+		t.Errorf("Blocks were %q, but expected %q", blocks, data)
+	}
+
+	if len(offsets) != 4 || offsets[3] != 48 {
+		t.Errorf("Offsets were %v, but expected [0 16 32 48]", offsets)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = tree.EachBlock(bytes.NewReader(data), func(offset uint64, key, block []byte) error {
+		n++
+		if offset == 16 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 2 {
+		t.Errorf("Error was %v after %d blocks, but expected stop after 2", err, n)
+	}
+}
@@ -0,0 +1,247 @@
+package kht
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// ErrNodeOutOfRange is returned when a node's level is greater than a tree's
+// depth, or when its index is outside of the tree.
+var ErrNodeOutOfRange = errors.New("kht: node out of range")
+
+// NodeKey returns the key of the node at the given level and index, where the
+// root is level 0 and the leaves are at the tree's depth. Indexes are counted
+// across the entire level, so the first child of the node at (1, 1) is the
+// node at (2, factor). Holding a node's key allows the derivation of every key
+// beneath it, but of no others. The key of a leaf node is returned as-is,
+// regardless of the tree's output length. NodeKey returns ErrNodeOutOfRange if
+// the node isn't in the tree, and ErrNoKey if the tree has no root key.
+func (t *KeyedHashTree) NodeKey(level, index uint64) ([]byte, error) {
+	if t.root == nil {
+		return nil, ErrNoKey
+	}
+
+	offset, err := t.nodeOffset(level, index)
+	if err != nil {
+		return nil, err
+	}
+
+	s := t.getScratch()
+	defer t.putScratch(s)
+
+	k := t.derive(s, offset, level)
+	key := make([]byte, len(k))
+	copy(key, k)
+	return key, nil
+}
+
+// Subtree returns a tree rooted at the node at the given level and index, which
+// derives the same keys as t for every offset the node covers and returns
+// errors for all other offsets. A subtree can be created from a node's key
+// alone (see NewSubtree), so holding one doesn't require the root key.
+func (t *KeyedHashTree) Subtree(level, index uint64) (*KeyedHashTree, error) {
+	k, err := t.NodeKey(level, index)
+	if err != nil {
+		return nil, err
+	}
+
+	base, _ := t.nodeOffset(level, index)
+	return t.subtree(k, level, base), nil
+}
+
+// NewSubtree returns a tree rooted at the node at the given level and index of
+// a tree with the given keyed hash algorithm, block size, maximum size, and
+// branching factor, given only that node's key (see NodeKey). It derives the
+// same keys as the full tree for every offset the node covers, and returns
+// errors for all other offsets. This allows a holder of the root key to
+// delegate the derivation of a range of keys without revealing the root key.
+//
+// The options must match those of the full tree, except for WithRootStretch
+// and WithContext, which are ignored: they only affect the root key, and so
+// are already reflected in the node's key.
+func NewSubtree(key []byte, alg KeyedHash, blockSize, maxSize uint64, factor float64, level, index uint64, opts ...Option) (*KeyedHashTree, error) {
+	if len(key) == 0 {
+		return nil, errors.New("kht: key must not be empty")
+	}
+
+	f, err := integralFactor(factor)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &KeyedHashTree{
+		alg:       alg,
+		blockSize: blockSize,
+		maxSize:   maxSize,
+		factor:    f,
+		nameLen:   16,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	if err := t.init(); err != nil {
+		return nil, err
+	}
+
+	base, err := t.nodeOffset(level, index)
+	if err != nil {
+		return nil, err
+	}
+	return t.subtree(append([]byte(nil), key...), level, base), nil
+}
+
+// NodeTree returns a tree rooted at the given node, with the same parameters as
+// t. Unlike Subtree, it doesn't require t to have a root key, so a tree decoded
+// with UnmarshalBinary can be combined with a node from RangeCover to
+// reconstruct a delegated subtree.
+func (t *KeyedHashTree) NodeTree(n Node) (*KeyedHashTree, error) {
+	if len(n.Key) == 0 {
+		return nil, errors.New("kht: key must not be empty")
+	}
+
+	base, err := t.nodeOffset(n.Level, n.Index)
+	if err != nil {
+		return nil, err
+	}
+	return t.subtree(append([]byte(nil), n.Key...), n.Level, base), nil
+}
+
+// subtree returns a tree rooted at the node with the given key, level, and
+// first offset.
+func (t *KeyedHashTree) subtree(key []byte, level, base uint64) *KeyedHashTree {
+	limit := t.limit
+	if level > 0 && t.sizes[level] < limit-base {
+		limit = base + t.sizes[level]
+	}
+
+	sub := new(KeyedHashTree)
+	sub.copyFrom(t)
+	Wipe(sub.root)
+	sub.root = key
+	sub.context = nil // the context is already mixed into the node's key
+	sub.stretch = 0
+	sub.argon2, sub.salt = nil, nil
+	sub.limit = limit
+	sub.top = level
+	sub.base = base
+	return sub
+}
+
+// nodeOffset returns the first offset covered by the node at the given level
+// and index, or ErrNodeOutOfRange if the node isn't in the tree.
+func (t *KeyedHashTree) nodeOffset(level, index uint64) (uint64, error) {
+	if level < t.top || level > t.depth {
+		return 0, ErrNodeOutOfRange
+	}
+
+	if level == 0 {
+		if index != 0 {
+			return 0, ErrNodeOutOfRange
+		}
+		return 0, nil
+	}
+
+	size := t.sizes[level]
+	if index > math.MaxUint64/size {
+		return 0, ErrNodeOutOfRange
+	}
+
+	offset := index * size
+	if level == t.top && offset != t.base || t.checkOffset(offset) != nil {
+		return 0, ErrNodeOutOfRange
+	}
+	return offset, nil
+}
+
+// A Node is a node in a tree, identified by its level and index, along with its
+// key.
+type Node struct {
+	Level, Index uint64
+	Key          []byte
+}
+
+// RangeCover returns the smallest set of nodes whose subtrees exactly cover the
+// blocks containing the bytes in [start, end), in offset order. Handing those
+// nodes to a client (see NewSubtree) allows it to derive the keys for that
+// range of blocks, and no others. Blocks which are only partially in the range
+// are covered in their entirety.
+//
+// It returns ErrOffsetOutOfRange if the range isn't within the tree, and
+// ErrNoKey if the tree has no root key.
+func (t *KeyedHashTree) RangeCover(start, end uint64) ([]Node, error) {
+	if t.root == nil {
+		return nil, ErrNoKey
+	}
+
+	if start >= end {
+		return nil, nil
+	}
+
+	if err := t.checkOffset(start); err != nil {
+		return nil, err
+	}
+
+	if err := t.checkOffset(end - 1); err != nil {
+		return nil, err
+	}
+
+	start -= start % t.blockSize
+	if r := end % t.blockSize; r != 0 {
+		if t.limit-end < t.blockSize-r {
+			end = t.limit // the last block is partial
+		} else {
+			end += t.blockSize - r
+		}
+	}
+
+	index := uint64(0)
+	if t.top > 0 {
+		index = t.base / t.sizes[t.top]
+	}
+
+	var nodes []Node
+	t.cover(&nodes, t.root, t.top, index, t.base, t.limit, start, end)
+	return nodes, nil
+}
+
+// cover appends the nodes which cover the part of [start, end) within the node
+// with the given key, level, index, and range of offsets [lo, hi).
+func (t *KeyedHashTree) cover(nodes *[]Node, key []byte, level, index, lo, hi, start, end uint64) {
+	if start <= lo && hi <= end {
+		*nodes = append(*nodes, Node{
+			Level: level,
+			Index: index,
+			Key:   append([]byte(nil), key...),
+		})
+		return
+	}
+
+	var buf [16]byte
+	size := t.sizes[level+1]
+	for i, clo := index*t.factor, lo; ; i, clo = i+1, clo+size {
+		chi := hi
+		if size < hi-clo {
+			chi = clo + size
+		}
+
+		if chi > start {
+			binary.LittleEndian.PutUint64(buf[:], level)
+			binary.LittleEndian.PutUint64(buf[8:], i)
+
+			h := t.alg(key)
+			_, _ = h.Write(buf[:])
+			k := h.Sum(nil)
+			wipeHash(h)
+
+			t.cover(nodes, k, level+1, i, clo, chi, start, end)
+			Wipe(k)
+		}
+
+		if chi >= hi || chi >= end {
+			return // the next child would be past the range, or overflow
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestNodeKey(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 128, 4)
+
+	root, err := tree.NodeKey(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []byte("yay"); !bytes.Equal(root, want) {
+		t.Errorf("Root key was %#v, but expected %#v", root, want)
+	}
+
+	for i := uint64(0); i < 64; i++ {
+		k, err := tree.NodeKey(3, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := tree.Key(i * 2); !bytes.Equal(k, want) {
+			t.Errorf("Leaf %d was %#v, but expected %#v", i, k, want)
+		}
+	}
+
+	nodes := [][2]uint64{{0, 1}, {1, 5}, {3, 65}, {4, 0}}
+	for _, n := range nodes {
+		if _, err := tree.NodeKey(n[0], n[1]); err != kht.ErrNodeOutOfRange {
+			t.Errorf("Error for node (%d, %d) was %v, but expected ErrNodeOutOfRange", n[0], n[1], err)
+		}
+	}
+}
+
+func TestNodeKeyCoordinates(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 128, 4)
+
+	// K(L, y) = H(K(L-1, y/factor), le64(L-1) || le64(y))
+	node := func(parent []byte, level, index uint64) []byte {
+		var msg [16]byte
+		binary.LittleEndian.PutUint64(msg[:8], level-1)
+		binary.LittleEndian.PutUint64(msg[8:], index)
+
+		h := hmac.New(md5.New, parent)
+		_, _ = h.Write(msg[:])
+		return h.Sum(nil)
+	}
+
+	want := []byte("yay")
+	for level, index := range []uint64{0, 1, 5, 22} {
+		if level > 0 {
+			want = node(want, uint64(level), index)
+		}
+
+		k, err := tree.NodeKey(uint64(level), index)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(k, want) {
+			t.Errorf("Node (%d, %d) was %#v, but expected %#v", level, index, k, want)
+		}
+	}
+}
+
+func TestSubtree(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 128, 4)
+
+	sub, err := tree.Subtree(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for offset := uint64(64); offset < 96; offset++ {
+		k, err := sub.KeyAt(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := tree.Key(offset); !bytes.Equal(k, want) {
+			t.Errorf("Key %d was %#v, but expected %#v", offset, k, want)
+		}
+	}
+
+	for _, offset := range []uint64{0, 63, 96, 128} {
+		if _, err := sub.KeyAt(offset); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+			t.Errorf("Error for %d was %v, but expected ErrOffsetOutOfRange", offset, err)
+		}
+	}
+
+	if start, end := sub.Range(); start != 64 || end != 96 {
+		t.Errorf("Subtree range was [%d, %d), but expected [64, 96)", start, end)
+	}
+
+	leaf, err := sub.NodeKey(3, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := tree.Key(80); !bytes.Equal(leaf, want) {
+		t.Errorf("Leaf was %#v, but expected %#v", leaf, want)
+	}
+
+	if _, err := sub.NodeKey(1, 1); err != kht.ErrNodeOutOfRange {
+		t.Errorf("Error was %v, but expected ErrNodeOutOfRange", err)
+	}
+
+	keys := sub.Keys(64, 16)
+	for i, k := range keys {
+		if want := tree.Key(64 + uint64(i)*2); !bytes.Equal(k, want) {
+			t.Errorf("Key %d was %#v, but expected %#v", i, k, want)
+		}
+	}
+}
+
+func TestNewSubtree(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 128, 4,
+		kht.WithContext([]byte("data")), kht.WithOutputLength(8, kht.Leading))
+
+	node, err := tree.NodeKey(2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := kht.NewSubtree(node, kht.HMAC(md5.New), 2, 128, 4, 2, 5,
+		kht.WithContext([]byte("data")), kht.WithOutputLength(8, kht.Leading))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for offset := uint64(0); offset < 128; offset++ {
+		k, err := sub.KeyAt(offset)
+		if offset < 40 || offset >= 48 {
+			if !errors.Is(err, kht.ErrOffsetOutOfRange) {
+				t.Errorf("Error for %d was %v, but expected ErrOffsetOutOfRange", offset, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := tree.Key(offset); !bytes.Equal(k, want) {
+			t.Errorf("Key %d was %#v, but expected %#v", offset, k, want)
+		}
+	}
+
+	if _, err := kht.NewSubtree(node, kht.HMAC(md5.New), 2, 128, 4, 2, 16); err != kht.ErrNodeOutOfRange {
+		t.Errorf("Error was %v, but expected ErrNodeOutOfRange", err)
+	}
+}
+
+func TestRangeCover(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 128, 4)
+
+	tests := []struct {
+		start, end uint64
+		nodes      [][2]uint64
+	}{
+		{0, 128, [][2]uint64{{0, 0}}},
+		{8, 72, [][2]uint64{{2, 1}, {2, 2}, {2, 3}, {1, 1}, {2, 8}}},
+		{9, 15, [][2]uint64{{2, 1}}},
+		{9, 12, [][2]uint64{{3, 4}, {3, 5}}},
+		{96, 128, [][2]uint64{{1, 3}}},
+		{5, 5, nil},
+	}
+
+	for _, test := range tests {
+		nodes, err := tree.RangeCover(test.start, test.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(nodes) != len(test.nodes) {
+			t.Errorf("Cover of [%d, %d) was %d nodes, but expected %v", test.start, test.end, len(nodes), test.nodes)
+			continue
+		}
+
+		for i, n := range nodes {
+			if n.Level != test.nodes[i][0] || n.Index != test.nodes[i][1] {
+				t.Errorf("Node %d of [%d, %d) was (%d, %d), but expected %v",
+					i, test.start, test.end, n.Level, n.Index, test.nodes[i])
+			}
+
+			want, err := tree.NodeKey(n.Level, n.Index)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(n.Key, want) {
+				t.Errorf("Key for (%d, %d) was %#v, but expected %#v", n.Level, n.Index, n.Key, want)
+			}
+		}
+	}
+
+	if _, err := tree.RangeCover(100, 129); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+
+	sub, err := tree.Subtree(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := sub.RangeCover(40, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nodes) != 3 || nodes[0].Level != 2 || nodes[0].Index != 5 {
+		t.Errorf("Subtree cover was %v, but expected (2, 5), (2, 6), (2, 7)", nodes)
+	}
+}
+
+func TestRangeCoverSaturated(t *testing.T) {
+	// The tree covers every offset, and its last block is a single byte.
+	tree, err := kht.NewWithDepth([]byte("yay"), kht.HMAC(md5.New), 7, 1000, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := tree.RangeCover(math.MaxUint64-10, math.MaxUint64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := uint64(math.MaxUint64-1) / 7
+	if len(nodes) != 3 {
+		t.Fatalf("Cover was %d nodes, but expected 3", len(nodes))
+	}
+
+	for i, n := range nodes {
+		if want := last - 2 + uint64(i); n.Level != 7 || n.Index != want {
+			t.Errorf("Node %d was (%d, %d), but expected (7, %d)", i, n.Level, n.Index, want)
+		}
+
+		want, err := tree.NodeKey(n.Level, n.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(n.Key, want) {
+			t.Errorf("Key for (%d, %d) was %#v, but expected %#v", n.Level, n.Index, n.Key, want)
+		}
+	}
+}
+
+func TestNodeTree(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 128, 4)
+
+	nodes, err := tree.RangeCover(8, 72)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var template kht.KeyedHashTree
+	if err := template.UnmarshalBinary(params); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range nodes {
+		sub, err := template.NodeTree(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for offset := uint64(8); offset < 72; offset++ {
+			k, err := sub.KeyAt(offset)
+			if err != nil {
+				continue
+			}
+
+			if want := tree.Key(offset); !bytes.Equal(k, want) {
+				t.Errorf("Key for %d was %#v, but expected %#v", offset, k, want)
+			}
+		}
+	}
+
+	if _, err := template.NodeTree(kht.Node{Level: 4, Key: []byte("yay")}); !errors.Is(err, kht.ErrNodeOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrNodeOutOfRange", err)
+	}
+}
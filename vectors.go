@@ -0,0 +1,143 @@
+package kht
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A Vector is a set of known-answer tests for a single tree, for checking
+// other implementations against this one. Vectors are encoded as JSON (see
+// WriteVectors), with keys hex-encoded.
+type Vector struct {
+	Key       string      `json:"key"`       // the root key, hex-encoded
+	Algorithm string      `json:"algorithm"` // the registered name of the keyed hash
+	BlockSize uint64      `json:"blockSize"`
+	MaxSize   uint64      `json:"maxSize"`
+	Factor    uint64      `json:"factor"`
+	Depth     uint64      `json:"depth"` // the tree's depth, which follows from the above
+	Keys      []KeyVector `json:"keys"`
+}
+
+// A KeyVector is the derived key at an offset of a Vector's tree.
+type KeyVector struct {
+	Offset uint64 `json:"offset"`
+	Key    string `json:"key"` // the derived key, hex-encoded
+}
+
+// NewVector returns a vector for the tree with the given root key, keyed hash
+// (by its registered name; see RegisterKeyedHash), block size, maximum size,
+// and branching factor, with the derived keys at the given offsets. It returns
+// an error if the tree can't be created or an offset is out of range.
+func NewVector(key []byte, algorithm string, blockSize, maxSize, factor uint64, offsets ...uint64) (Vector, error) {
+	v := Vector{
+		Key:       hex.EncodeToString(key),
+		Algorithm: algorithm,
+		BlockSize: blockSize,
+		MaxSize:   maxSize,
+		Factor:    factor,
+	}
+
+	t, err := v.tree()
+	if err != nil {
+		return Vector{}, err
+	}
+	defer t.Wipe()
+
+	v.Depth = t.Depth()
+	for _, offset := range offsets {
+		k, err := t.KeyAt(offset)
+		if err != nil {
+			return Vector{}, err
+		}
+
+		v.Keys = append(v.Keys, KeyVector{Offset: offset, Key: hex.EncodeToString(k)})
+		Wipe(k)
+	}
+	return v, nil
+}
+
+// WriteVectors writes the given vectors to w as an indented JSON array,
+// followed by a newline. The output is stable, so it can be compared byte for
+// byte with previously written vectors.
+func WriteVectors(w io.Writer, vectors []Vector) error {
+	b, err := json.MarshalIndent(vectors, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// VerifyVectors reads a JSON array of vectors, as written by WriteVectors,
+// from r and checks that this implementation derives the same depth and keys
+// for each of them. It returns an error describing the first mismatch, or if
+// r contains no vectors.
+func VerifyVectors(r io.Reader) error {
+	var vectors []Vector
+	if err := json.NewDecoder(r).Decode(&vectors); err != nil {
+		return err
+	}
+
+	if len(vectors) == 0 {
+		return errors.New("kht: no vectors")
+	}
+
+	for i, v := range vectors {
+		if err := v.verify(); err != nil {
+			return fmt.Errorf("kht: vector %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// verify checks the vector against a tree built from its parameters.
+func (v Vector) verify() error {
+	t, err := v.tree()
+	if err != nil {
+		return err
+	}
+	defer t.Wipe()
+
+	if t.Depth() != v.Depth {
+		return fmt.Errorf("depth was %d, but expected %d", t.Depth(), v.Depth)
+	}
+
+	for _, kv := range v.Keys {
+		want, err := hex.DecodeString(kv.Key)
+		if err != nil {
+			return err
+		}
+
+		k, err := t.KeyAt(kv.Offset)
+		if err != nil {
+			return err
+		}
+
+		ok := bytes.Equal(k, want)
+		Wipe(k)
+		if !ok {
+			return fmt.Errorf("key at offset %d doesn't match", kv.Offset)
+		}
+	}
+	return nil
+}
+
+// tree returns the vector's tree.
+func (v Vector) tree() (*KeyedHashTree, error) {
+	key, err := hex.DecodeString(v.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+
+	alg, err := lookupHash(v.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return NewInt(key, alg, v.BlockSize, v.MaxSize, v.Factor)
+}
@@ -0,0 +1,153 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+var update = flag.Bool("update", false, "regenerate testdata/vectors.json")
+
+var vectorTrees = []struct {
+	key                        string
+	algorithm                  string
+	blockSize, maxSize, factor uint64
+	offsets                    []uint64
+}{
+	{
+		key:       "yay",
+		algorithm: "HMAC-MD5",
+		blockSize: 2,
+		maxSize:   16,
+		factor:    8,
+		offsets:   []uint64{0, 1, 2, 15},
+	},
+	{
+		key:       "0123456789abcdef0123456789abcdef",
+		algorithm: "HMAC-SHA256",
+		blockSize: 1024,
+		maxSize:   1 << 30,
+		factor:    1024,
+		// the first block, the last block of the first level-1 node, the first
+		// block of the second level-1 node, and the last valid offset
+		offsets: []uint64{0, 1<<20 - 1, 1 << 20, 1<<30 - 1},
+	},
+	{
+		key:       "0123456789abcdef0123456789abcdef",
+		algorithm: "HMAC-SHA256",
+		blockSize: 4096,
+		maxSize:   1 << 40,
+		factor:    1024,
+		offsets:   []uint64{0, 4095, 4096, 1<<22 - 1, 1 << 22, 1<<32 - 1, 1 << 32, 1<<40 - 1},
+	},
+	{
+		key:       "0123456789abcdef0123456789abcdef",
+		algorithm: "HKDF-SHA256",
+		blockSize: 1024,
+		maxSize:   1 << 30,
+		factor:    1024,
+		offsets:   []uint64{0, 1<<20 - 1, 1 << 20, 1<<30 - 1},
+	},
+}
+
+func generateVectors(t *testing.T) []byte {
+	var vectors []kht.Vector
+	for _, v := range vectorTrees {
+		vector, err := kht.NewVector([]byte(v.key), v.algorithm, v.blockSize, v.maxSize, v.factor, v.offsets...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vectors = append(vectors, vector)
+	}
+
+	var buf bytes.Buffer
+	if err := kht.WriteVectors(&buf, vectors); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVectors(t *testing.T) {
+	generated := generateVectors(t)
+
+	if *update {
+		if err := os.WriteFile("testdata/vectors.json", generated, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := os.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(generated, expected) {
+		t.Error("Derived keys don't match testdata/vectors.json")
+	}
+}
+
+func TestVerifyVectors(t *testing.T) {
+	f, err := os.Open("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := kht.VerifyVectors(f); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewVectorLargeFactor(t *testing.T) {
+	// The factor isn't representable as a float64.
+	v, err := kht.NewVector([]byte("yay"), "HMAC-MD5", 1, 1<<63, 1<<61+1, 1<<62+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := kht.NewInt([]byte("yay"), kht.HMAC(md5.New), 1, 1<<63, 1<<61+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, want := v.Keys[0].Key, hex.EncodeToString(tree.Key(1<<62+1)); v != want {
+		t.Errorf("Key was %s, but expected %s", v, want)
+	}
+}
+
+func TestVerifyVectorsMismatch(t *testing.T) {
+	v, err := kht.NewVector([]byte("yay"), "HMAC-MD5", 2, 16, 8, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depth := v
+	depth.Depth++
+
+	key := v
+	key.Keys = []kht.KeyVector{v.Keys[0], {Offset: 2, Key: v.Keys[0].Key}}
+
+	tests := map[string][]kht.Vector{
+		"no vectors": nil,
+		"depth":      {v, depth},
+		"key":        {v, key},
+	}
+	for name, vectors := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := json.Marshal(vectors)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := kht.VerifyVectors(bytes.NewReader(b)); err == nil {
+				t.Error("Verified mismatched vectors")
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package kht
+
+import (
+	"hash"
+	"runtime"
+)
+
+// Wipe overwrites the given key with zeros. Call it on keys returned by the
+// tree once they're no longer needed.
+//
+// Wiping is best-effort. The tree wipes its own copies of intermediate node
+// keys after each derivation, but the Go runtime may have copied a key's bytes
+// elsewhere (e.g., when growing a slice or moving a goroutine's stack), and the
+// internal buffers of the underlying hash functions can't be wiped from
+// outside their packages. Wipe only guarantees that the given slice no longer
+// holds the key.
+func Wipe(key []byte) {
+	clear(key)
+	runtime.KeepAlive(key)
+}
+
+// Wipe zeroes the tree's root key and any cached node keys, and removes them
+// from the tree, which can't derive keys afterwards (see ErrNoKey) until it's
+// given a new root key with SetKey. The tree holds its own copy of the root
+// key, so wiping the tree doesn't affect the key passed to New, and vice versa;
+// the same goes for subtrees and grown trees, which hold their own copies of
+// their root keys.
+//
+// Scratch space is wiped after every derivation, so once Wipe returns, the
+// only key material derived from the tree is in the keys returned to the
+// caller, which should be wiped with the Wipe function. The caveats of that
+// function apply here too.
+func (t *KeyedHashTree) Wipe() {
+	Wipe(t.root)
+	t.root = nil
+	if t.cache != nil {
+		t.cache.wipe()
+	}
+	if t.pre != nil {
+		t.pre.wipe()
+		t.pre = nil
+	}
+}
+
+// Close wipes the tree, as with Wipe, and returns nil. It allows a tree to be
+// used as an io.Closer.
+func (t *KeyedHashTree) Close() error {
+	t.Wipe()
+	return nil
+}
+
+// wipeHash wipes what it can of a keyed hash's state.
+func wipeHash(h hash.Hash) {
+	switch h := h.(type) {
+	case *hmacHash:
+		h.wipe()
+	case *hkdfHash:
+		Wipe(h.info)
+		h.mac.wipe()
+	case *kmacHash:
+		h.wipe()
+	default:
+		h.Reset()
+	}
+}
@@ -0,0 +1,71 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"testing"
+
+	"github.com/codahale/kht"
+)
+
+func TestWipe(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(md5.New), 2, 16, 8)
+
+	k := tree.Key(0)
+	kht.Wipe(k)
+
+	if want := make([]byte, md5.Size); !bytes.Equal(k, want) {
+		t.Errorf("Key was %#v, but expected %#v", k, want)
+	}
+
+	if bytes.Equal(tree.Key(0), k) {
+		t.Error("Wiping a key affected the tree")
+	}
+}
+
+func TestTreeWipe(t *testing.T) {
+	key := []byte("yay")
+	tree := mustNew(t, key, kht.HMAC(md5.New), 2, 128, 4, kht.WithNodeCache(8))
+	want := tree.Key(100)
+
+	sub, err := tree.Subtree(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grown, err := tree.Grow(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(key, []byte("yay")) {
+		t.Errorf("Wiping the tree wiped the caller's key: %#v", key)
+	}
+
+	if _, err := tree.KeyAt(100); err != kht.ErrNoKey {
+		t.Errorf("Error was %v, but expected ErrNoKey", err)
+	}
+
+	if n := tree.CacheStats().Entries; n != 0 {
+		t.Errorf("Cache had %d entries after wiping, but expected none", n)
+	}
+
+	for _, other := range []*kht.KeyedHashTree{sub, grown} {
+		if v := other.Key(100); !bytes.Equal(v, want) {
+			t.Errorf("Key after wiping the parent was %#v, but expected %#v", v, want)
+		}
+	}
+
+	if err := tree.SetKey(key); err != nil {
+		t.Fatal(err)
+	}
+
+	kht.Wipe(key)
+	if v := tree.Key(100); !bytes.Equal(v, want) {
+		t.Errorf("Key after wiping the caller's key was %#v, but expected %#v", v, want)
+	}
+}
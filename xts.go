@@ -0,0 +1,62 @@
+package kht
+
+import (
+	"crypto/aes"
+	"errors"
+
+	"golang.org/x/crypto/xts"
+)
+
+var errSectorSize = errors.New("kht: sectors must be exactly one block long")
+
+// EncryptSector encrypts src, which must be exactly one block long, into dst,
+// as the sector containing the given offset. Blocks are encrypted with
+// XTS-AES-256, using the first 64 bytes of HKDF-Expand key material for the
+// sector's offset (see KeyN) as the XTS key and the sector number (the offset
+// divided by the block size) as the tweak, so any standard XTS-AES
+// implementation can decrypt a sector given its key. The block size must be a
+// multiple of 16 bytes, and dst must be at least one block long. Unlike the
+// AEAD helpers, XTS is length-preserving but unauthenticated.
+//
+// EncryptSector returns an *OffsetError if the offset is out of range, and
+// ErrNoKey if the tree has no root key.
+func (t *KeyedHashTree) EncryptSector(dst, src []byte, offset uint64) error {
+	c, err := t.sectorCipher(dst, src, offset)
+	if err != nil {
+		return err
+	}
+	c.Encrypt(dst, src, offset/t.blockSize)
+	return nil
+}
+
+// DecryptSector decrypts src, which must be exactly one block long, into dst,
+// as the sector containing the given offset. It's the inverse of EncryptSector.
+func (t *KeyedHashTree) DecryptSector(dst, src []byte, offset uint64) error {
+	c, err := t.sectorCipher(dst, src, offset)
+	if err != nil {
+		return err
+	}
+	c.Decrypt(dst, src, offset/t.blockSize)
+	return nil
+}
+
+// sectorCipher returns the XTS cipher for the sector containing the given
+// offset.
+func (t *KeyedHashTree) sectorCipher(dst, src []byte, offset uint64) (*xts.Cipher, error) {
+	if t.blockSize%aes.BlockSize != 0 || uint64(len(src)) != t.blockSize || uint64(len(dst)) < t.blockSize {
+		return nil, errSectorSize
+	}
+
+	if t.root == nil {
+		return nil, ErrNoKey
+	}
+
+	if err := t.checkOffset(offset); err != nil {
+		return nil, err
+	}
+
+	k := t.KeyN(offset, 64)
+	defer Wipe(k)
+
+	return xts.NewCipher(aes.NewCipher, k)
+}
@@ -0,0 +1,69 @@
+package kht_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/codahale/kht"
+	"golang.org/x/crypto/xts"
+)
+
+func TestEncryptSector(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 512, 1<<20, 64)
+	plaintext := bytes.Repeat([]byte("0123456789abcdef"), 32)
+
+	ct := make([]byte, 512)
+	if err := tree.EncryptSector(ct, plaintext, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := xts.NewCipher(aes.NewCipher, tree.KeyN(1024, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]byte, 512)
+	c.Encrypt(want, plaintext, 2)
+	if !bytes.Equal(ct, want) {
+		t.Error("Ciphertext didn't match standard XTS-AES-256")
+	}
+
+	pt := make([]byte, 512)
+	if err := tree.DecryptSector(pt, ct, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(pt, plaintext) {
+		t.Error("Plaintext didn't match")
+	}
+
+	other := make([]byte, 512)
+	if err := tree.EncryptSector(other, plaintext, 1536); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(other, ct) {
+		t.Error("Different sectors had the same ciphertext")
+	}
+}
+
+func TestEncryptSectorInvalid(t *testing.T) {
+	tree := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 512, 1<<20, 64)
+	buf := make([]byte, 512)
+
+	if err := tree.EncryptSector(buf, buf[:100], 0); err == nil {
+		t.Error("Encrypted a partial sector")
+	}
+
+	if err := tree.EncryptSector(buf, buf, 1<<21); !errors.Is(err, kht.ErrOffsetOutOfRange) {
+		t.Errorf("Error was %v, but expected ErrOffsetOutOfRange", err)
+	}
+
+	odd := mustNew(t, []byte("yay"), kht.HMAC(sha256.New), 10, 1000, 10)
+	if err := odd.EncryptSector(buf[:10], buf[:10], 0); err == nil {
+		t.Error("Encrypted a sector which isn't a multiple of the AES block size")
+	}
+}